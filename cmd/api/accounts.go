@@ -0,0 +1,332 @@
+package main
+
+import (
+	"archive/zip"
+	"autherain/golang_arxiv/internal/data"
+	"autherain/golang_arxiv/internal/validator"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	purgeInterval = time.Hour
+	purgeTimeout  = time.Minute
+
+	exportPageSize = 100
+)
+
+// accountExport is everything held about a user, as returned by the export
+// endpoint.
+type accountExport struct {
+	User        *data.User         `json:"user"`
+	Permissions data.Permissions   `json:"permissions"`
+	Tokens      []exportedToken    `json:"tokens"`
+	APIKeys     []*data.APIKey     `json:"api_keys"`
+	Identities  []*data.Identity   `json:"identities"`
+	Movies      []*data.Movie      `json:"movies"`
+	Audit       []*data.AuditEntry `json:"audit"`
+}
+
+// exportedToken describes a token without anything that would let it be
+// used.
+type exportedToken struct {
+	Scope      string     `json:"scope"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	Expiry     time.Time  `json:"expiry"`
+	IP         string     `json:"ip"`
+	UserAgent  string     `json:"user_agent"`
+}
+
+// deleteCurrentUserHandler schedules the user's account for deletion. The
+// user confirms it with their password or, since users created at their first
+// OpenID Connect login never learn theirs, with "oidc": the callback of a
+// login started with POST /v1/tokens/oidc as one of their linked identities.
+func (app *application) deleteCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	var input struct {
+		Password string        `json:"password"`
+		OIDC     *oidcCallback `json:"oidc"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	switch {
+	case input.OIDC == nil:
+		v.Check(input.Password != "", "password", "must be provided")
+	case app.sso == nil:
+		v.AddError("oidc", "is not supported, as OpenID Connect is not configured")
+	default:
+		validateOIDCCallback(v, input.OIDC)
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if input.OIDC != nil {
+		err := app.confirmOIDCIdentity(r.Context(), user, input.OIDC)
+		if err != nil {
+			app.oidcLoginErrorResponse(w, r, err)
+			return
+		}
+	} else {
+		match, err := user.Password.Matches(input.Password)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		if !match {
+			v.AddError("password", "is incorrect")
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+	}
+
+	requestedAt := time.Now()
+
+	// Every token is revoked, so the account can only be restored by
+	// logging in again, which cancels the deletion.
+	err = app.models.WithTx(r.Context(), func(tx data.Models) error {
+		updated := *user
+		updated.DeletionRequestedAt = &requestedAt
+
+		err := tx.Users.Update(r.Context(), &updated)
+		if err != nil {
+			return err
+		}
+
+		err = app.revokeSessions(r.Context(), tx, user.ID)
+		if err != nil {
+			return err
+		}
+
+		err = tx.APIKeys.DeleteAllForUser(r.Context(), user.ID)
+		if err != nil {
+			return err
+		}
+
+		for _, scope := range []string{data.ScopeActivation, data.ScopePasswordReset} {
+			err := tx.Tokens.DeleteAllForUser(r.Context(), scope, user.ID)
+			if err != nil {
+				return err
+			}
+		}
+
+		return tx.Audit.Insert(r.Context(), &data.AuditEntry{UserID: user.ID, Action: data.AuditDeletionRequested})
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.dataErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	env := envelope{
+		"message":  "your account is scheduled for deletion; log in before then to cancel it",
+		"purge_at": requestedAt.Add(app.config.accounts.deletionGracePeriod).Truncate(time.Second),
+	}
+
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) exportCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	v := validator.New()
+
+	format := app.readString(r.URL.Query(), "format", "json")
+
+	if v.Check(validator.PermittedValue(format, "json", "zip"), "format", "must be json or zip"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	var export *accountExport
+
+	// Reading everything in one transaction gives a consistent export, and
+	// the audit entry is only kept if the export could be read.
+	err := app.models.WithTx(r.Context(), func(tx data.Models) error {
+		err := tx.Audit.Insert(r.Context(), &data.AuditEntry{UserID: user.ID, Action: data.AuditDataExported})
+		if err != nil {
+			return err
+		}
+
+		export, err = app.readAccountExport(r.Context(), tx, user)
+		return err
+	})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if format == "json" {
+		err = app.writeJSON(w, http.StatusOK, envelope{"export": export}, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	files := []struct {
+		name string
+		data any
+	}{
+		{"profile.json", export.User},
+		{"permissions.json", export.Permissions},
+		{"tokens.json", export.Tokens},
+		{"api_keys.json", export.APIKeys},
+		{"identities.json", export.Identities},
+		{"movies.json", export.Movies},
+		{"audit.json", export.Audit},
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="user-%d-export.zip"`, user.ID))
+
+	zw := zip.NewWriter(w)
+
+	for _, file := range files {
+		js, err := json.MarshalIndent(file.data, "", "\t")
+		if err != nil {
+			app.logError(r, err)
+			return
+		}
+
+		f, err := zw.Create(file.name)
+		if err != nil {
+			app.logError(r, err)
+			return
+		}
+
+		_, err = f.Write(append(js, '\n'))
+		if err != nil {
+			app.logError(r, err)
+			return
+		}
+	}
+
+	err = zw.Close()
+	if err != nil {
+		app.logError(r, err)
+	}
+}
+
+func (app *application) readAccountExport(ctx context.Context, models data.Models, user *data.User) (*accountExport, error) {
+	export := &accountExport{User: user, Tokens: []exportedToken{}, Movies: []*data.Movie{}}
+
+	permissions, err := models.Permissions.GetAllForUser(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	export.Permissions = permissions
+
+	tokens, err := models.Tokens.GetAllForUser(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, token := range tokens {
+		export.Tokens = append(export.Tokens, exportedToken{
+			Scope:      token.Scope,
+			CreatedAt:  token.CreatedAt,
+			LastUsedAt: token.LastUsedAt,
+			Expiry:     token.Expiry,
+			IP:         token.IP,
+			UserAgent:  token.UserAgent,
+		})
+	}
+
+	export.APIKeys, err = models.APIKeys.GetAllForUser(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	export.Identities, err = models.Identities.GetAllForUser(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	filters := data.Filters{Page: 1, PageSize: exportPageSize, Sort: "id", SortSafelist: []string{"id"}}
+
+	for {
+		movies, _, err := models.Movies.GetAllForOwner(ctx, user.ID, filters)
+		if err != nil {
+			return nil, err
+		}
+
+		export.Movies = append(export.Movies, movies...)
+
+		if len(movies) < filters.PageSize {
+			break
+		}
+
+		filters.Page++
+	}
+
+	export.Audit, err = models.Audit.GetAllForUser(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return export, nil
+}
+
+// purgeDeletedUsers deletes, on an interval, the accounts whose deletion was
+// requested longer ago than the grace period.
+func (app *application) purgeDeletedUsers(interval time.Duration) {
+	purge := func() {
+		ctx, cancel := context.WithTimeout(context.Background(), purgeTimeout)
+		defer cancel()
+
+		var purged []int64
+
+		err := app.models.WithTx(ctx, func(tx data.Models) error {
+			ids, err := tx.Users.PurgeDeleted(ctx, time.Now().Add(-app.config.accounts.deletionGracePeriod))
+			if err != nil {
+				return err
+			}
+
+			for _, id := range ids {
+				err := tx.Audit.Insert(ctx, &data.AuditEntry{UserID: id, Action: data.AuditPurged})
+				if err != nil {
+					return err
+				}
+			}
+
+			purged = ids
+			return nil
+		})
+
+		switch {
+		case err != nil:
+			app.logger.Error("failed to purge deleted users", zap.Error(err))
+		case len(purged) > 0:
+			app.logger.Info("purged deleted users", zap.Int64s("user_ids", purged))
+		}
+	}
+
+	app.background(purge)
+	app.every(interval, purge)
+}
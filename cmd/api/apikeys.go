@@ -0,0 +1,137 @@
+package main
+
+import (
+	"autherain/golang_arxiv/internal/data"
+	"autherain/golang_arxiv/internal/validator"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// authenticateAPIKey returns the request carrying the owner of the key and
+// the key itself, or data.ErrRecordNotFound if the key is unknown or has
+// expired.
+func (app *application) authenticateAPIKey(r *http.Request, keyPlaintext string) (*http.Request, error) {
+	v := validator.New()
+
+	if data.ValidateAPIKeyPlaintext(v, keyPlaintext); !v.Valid() {
+		return nil, data.ErrRecordNotFound
+	}
+
+	key, err := app.models.APIKeys.GetByPlaintext(r.Context(), keyPlaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := app.models.Users.Get(r.Context(), key.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	r = app.contextSetUser(r, user)
+	r = app.contextSetAPIKey(r, key)
+
+	return r, nil
+}
+
+func (app *application) createAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	var input struct {
+		Name        string     `json:"name"`
+		Permissions []string   `json:"permissions"`
+		Expiry      *time.Time `json:"expiry"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	granted, err := app.models.Permissions.GetAllForUser(r.Context(), user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	key, err := data.GenerateAPIKey(user.ID, input.Name, input.Permissions, input.Expiry)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateAPIKey(v, key, granted); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.WithTx(r.Context(), func(tx data.Models) error {
+		err := tx.APIKeys.Insert(r.Context(), key)
+		if err != nil {
+			return err
+		}
+
+		return tx.Audit.Insert(r.Context(), &data.AuditEntry{UserID: user.ID, Action: data.AuditAPIKeyCreated})
+	})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// The plaintext is not stored, so this is the only time it is shown.
+	err = app.writeJSON(w, http.StatusCreated, envelope{"api_key": key}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listAPIKeysHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	keys, err := app.models.APIKeys.GetAllForUser(r.Context(), user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"api_keys": keys}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	err = app.models.WithTx(r.Context(), func(tx data.Models) error {
+		err := tx.APIKeys.Delete(r.Context(), user.ID, id)
+		if err != nil {
+			return err
+		}
+
+		return tx.Audit.Insert(r.Context(), &data.AuditEntry{UserID: user.ID, Action: data.AuditAPIKeyRevoked})
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "API key successfully revoked"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -1,14 +1,22 @@
 package main
 
 import (
+	"autherain/golang_arxiv/internal/data"
+	"autherain/golang_arxiv/internal/migrate"
+	"autherain/golang_arxiv/internal/pubsub"
+	"autherain/golang_arxiv/internal/signedtoken"
+	"autherain/golang_arxiv/internal/sso"
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"net"
 	"os"
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/uptrace/opentelemetry-go-extra/otelzap"
 )
 
 type config struct {
@@ -16,11 +24,74 @@ type config struct {
 	env         string
 	serviceName string
 	version     float64
-	db          struct {
+	storage     struct {
+		backend string
+	}
+	db struct {
 		dsn          string
 		maxOpenConns int
 		maxIdleConns int
 		maxIdleTime  time.Duration
+		queryTimeout time.Duration
+		autoMigrate  bool
+		replicaDSNs  []string
+		// readYourWritesWindow is how long reads by a user who has just
+		// written stay on the primary.
+		readYourWritesWindow time.Duration
+		slowQueryThreshold   time.Duration
+	}
+	cache struct {
+		enabled bool
+		size    int
+		ttl     time.Duration
+	}
+	pubsub struct {
+		enabled bool
+		channel string
+	}
+	auth struct {
+		// mode is "stateful", where login issues tokens stored in the
+		// database, or "stateless", where it issues signed tokens that
+		// carry the user's activation state and permissions. Changes to
+		// either only reach a signed token when it is refreshed. Stored
+		// tokens are accepted in both modes.
+		mode            string
+		accessTokenTTL  time.Duration
+		refreshTokenTTL time.Duration
+		// refreshGracePeriod is how long after a refresh token is exchanged
+		// presenting it again is taken for a client retrying a lost
+		// response, and refused, rather than for reuse, which revokes the
+		// session.
+		refreshGracePeriod time.Duration
+		// signingKeys are the keys for signed tokens as ID:BASE64SECRET
+		// pairs; the first signs and all of them verify.
+		signingKeys string
+		// denylist makes revoking a session deny its signed tokens too,
+		// at the cost of a lookup per request.
+		denylist bool
+	}
+	sessions struct {
+		// touchInterval is how often the last use of an authentication
+		// token is written back.
+		touchInterval time.Duration
+	}
+	accounts struct {
+		// deletionGracePeriod is how long a deleted account can still be
+		// restored by logging in before it is purged.
+		deletionGracePeriod time.Duration
+	}
+	oidc struct {
+		// issuerURL enables OpenID Connect login when set. redirectURL
+		// is the client page the provider returns the user to, which
+		// posts the code and state it receives to the callback endpoint.
+		issuerURL    string
+		clientID     string
+		clientSecret string
+		redirectURL  string
+		scopes       []string
+		// defaultPermissions are granted to users created on their first
+		// OpenID Connect login.
+		defaultPermissions []string
 	}
 	limiter struct {
 		enabled bool
@@ -61,16 +132,42 @@ func loadConfig() config {
 	cfg.env = os.Getenv("ENV")
 	cfg.serviceName = os.Getenv("SERVICE_NAME")
 
+	cfg.storage.backend = getEnvAsString("STORAGE_BACKEND", "database")
+
 	dbUsername := os.Getenv("DB_USERNAME")
 	dbPassword := os.Getenv("DB_PASSWORD")
 	dbHost := getDBHost()
 	dbPort := os.Getenv("DB_PORT")
 	dbName := os.Getenv("DB_DATABASE")
-	cfg.db.dsn = fmt.Sprintf("postgresql://%s:%s@%s:%s/%s?sslmode=disable", dbUsername, dbPassword, dbHost, dbPort, dbName)
+	cfg.db.dsn = getEnvAsString("DB_DSN", fmt.Sprintf("postgresql://%s:%s@%s:%s/%s?sslmode=disable", dbUsername, dbPassword, dbHost, dbPort, dbName))
 
 	cfg.db.maxOpenConns = getEnvAsInt("DB_MAX_OPEN_CONNS", 25)
 	cfg.db.maxIdleConns = getEnvAsInt("DB_MAX_IDLE_CONNS", 25)
 	cfg.db.maxIdleTime = getEnvAsDuration("DB_MAX_IDLE_TIME", 15*time.Minute)
+	cfg.db.queryTimeout = getEnvAsDuration("DB_QUERY_TIMEOUT", data.DefaultQueryTimeout)
+	cfg.db.autoMigrate = getEnvAsBool("DB_AUTO_MIGRATE", false)
+	cfg.db.replicaDSNs = strings.Fields(os.Getenv("DB_REPLICA_DSNS"))
+	cfg.db.readYourWritesWindow = getEnvAsDuration("DB_READ_YOUR_WRITES_WINDOW", 5*time.Second)
+	cfg.db.slowQueryThreshold = getEnvAsDuration("DB_SLOW_QUERY_THRESHOLD", 200*time.Millisecond)
+	cfg.cache.enabled = getEnvAsBool("CACHE_ENABLED", true)
+	cfg.cache.size = getEnvAsInt("CACHE_SIZE", 10000)
+	cfg.cache.ttl = getEnvAsDuration("CACHE_TTL", 30*time.Second)
+	cfg.pubsub.enabled = getEnvAsBool("PUBSUB_ENABLED", true)
+	cfg.pubsub.channel = getEnvAsString("PUBSUB_CHANNEL", "api_events")
+	cfg.auth.mode = getEnvAsString("AUTH_MODE", "stateful")
+	cfg.auth.signingKeys = os.Getenv("AUTH_SIGNING_KEYS")
+	cfg.auth.denylist = getEnvAsBool("AUTH_DENYLIST_ENABLED", true)
+	cfg.auth.accessTokenTTL = getEnvAsDuration("AUTH_ACCESS_TOKEN_TTL", 15*time.Minute)
+	cfg.auth.refreshTokenTTL = getEnvAsDuration("AUTH_REFRESH_TOKEN_TTL", 30*24*time.Hour)
+	cfg.auth.refreshGracePeriod = getEnvAsDuration("AUTH_REFRESH_GRACE_PERIOD", 5*time.Second)
+	cfg.sessions.touchInterval = getEnvAsDuration("SESSION_TOUCH_INTERVAL", time.Minute)
+	cfg.accounts.deletionGracePeriod = getEnvAsDuration("ACCOUNT_DELETION_GRACE_PERIOD", 30*24*time.Hour)
+	cfg.oidc.issuerURL = os.Getenv("OIDC_ISSUER_URL")
+	cfg.oidc.clientID = os.Getenv("OIDC_CLIENT_ID")
+	cfg.oidc.clientSecret = os.Getenv("OIDC_CLIENT_SECRET")
+	cfg.oidc.redirectURL = os.Getenv("OIDC_REDIRECT_URL")
+	cfg.oidc.scopes = strings.Fields(getEnvAsString("OIDC_SCOPES", "openid email profile"))
+	cfg.oidc.defaultPermissions = strings.Fields(getEnvAsString("OIDC_DEFAULT_PERMISSIONS", "movies:read"))
 	cfg.limiter.enabled = getEnvAsBool("LIMITER_ENABLED", true)
 	cfg.limiter.rps = getEnvAsFloat64("LIMITER_RPS", 2)
 	cfg.limiter.burst = getEnvAsInt("LIMITER_BURST", 4)
@@ -102,10 +199,222 @@ func getDBHost() string {
 	return "localhost"
 }
 
-func openDB(cfg config) (*sql.DB, error) {
-	db, err := sql.Open("postgres", cfg.db.dsn)
+// storage is what openStorage sets up for the configured backend. The
+// migrator is nil and pools is empty unless the backend is a database.
+type storage struct {
+	models   data.Models
+	migrator *migrate.Migrator
+	pools    []*data.Pool
+	close    func()
+}
+
+// openStorage opens the configured backend. For a database, pending
+// migrations are applied first when DB_AUTO_MIGRATE is set, and a pool is
+// opened for each DB_REPLICA_DSNS entry. With postgres, writes are announced
+// to the other API processes over LISTEN/NOTIFY unless PUBSUB_ENABLED is
+// false, and their announcements invalidate the cache.
+func openStorage(cfg config, logger *otelzap.Logger) (*storage, error) {
+	switch cfg.storage.backend {
+	case "memory":
+		return &storage{models: data.NewMemoryModels(), close: func() {}}, nil
+	// postgres was the name of this backend before SQLite was supported,
+	// and is still accepted for existing deployments.
+	case "database", "postgres":
+		db, driver, err := openDB(cfg, cfg.db.dsn)
+		if err != nil {
+			return nil, err
+		}
+
+		s := &storage{
+			pools: []*data.Pool{data.NewPool("primary", db)},
+		}
+
+		s.close = func() {
+			for _, pool := range s.pools {
+				pool.DB.Close()
+			}
+		}
+
+		s.migrator, err = migrate.New(db, driver)
+		if err != nil {
+			s.close()
+			return nil, err
+		}
+
+		if cfg.db.autoMigrate {
+			err = s.migrator.Up(context.Background())
+			if err != nil {
+				s.close()
+				return nil, err
+			}
+		}
+
+		queryConfig := data.QueryConfig{
+			Timeout:       cfg.db.queryTimeout,
+			SlowThreshold: cfg.db.slowQueryThreshold,
+			Logger:        logger,
+		}
+
+		if driver == "sqlite" {
+			if len(cfg.db.replicaDSNs) > 0 {
+				s.close()
+				return nil, errors.New("read replicas are only supported with postgres")
+			}
+
+			s.models = data.NewSQLiteModels(db, queryConfig)
+			if caches := newCaches(cfg); caches != nil {
+				s.models = s.models.WithCache(*caches)
+			}
+
+			return s, nil
+		}
+
+		for i, dsn := range cfg.db.replicaDSNs {
+			replica, replicaDriver, err := openDB(cfg, dsn)
+			if err != nil {
+				s.close()
+				return nil, fmt.Errorf("replica %d: %w", i+1, err)
+			}
+
+			if replicaDriver != driver {
+				replica.Close()
+				s.close()
+				return nil, fmt.Errorf("replica %d: must use the same database as the primary", i+1)
+			}
+
+			s.pools = append(s.pools, data.NewPool(fmt.Sprintf("replica_%d", i+1), replica))
+		}
+
+		s.models = data.NewModels(db, data.NewReplicaSet(s.pools[1:]...), queryConfig)
+
+		caches := newCaches(cfg)
+		if caches != nil {
+			s.models = s.models.WithCache(*caches)
+		}
+
+		if cfg.pubsub.enabled {
+			bus, err := pubsub.NewPostgres(db, cfg.db.dsn, cfg.pubsub.channel, logger)
+			if err != nil {
+				s.close()
+				return nil, fmt.Errorf("event bus: %w", err)
+			}
+
+			closePools := s.close
+			s.close = func() {
+				bus.Close()
+				closePools()
+			}
+
+			if caches != nil {
+				bus.Subscribe(caches.Invalidate)
+			}
+
+			s.models = s.models.WithEvents(bus)
+		}
+
+		return s, nil
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", cfg.storage.backend)
+	}
+}
+
+// newCaches returns the caches to put in front of database models, or nil
+// when CACHE_ENABLED is false.
+func newCaches(cfg config) *data.Caches {
+	if !cfg.cache.enabled || cfg.cache.size <= 0 {
+		return nil
+	}
+
+	caches := data.NewLRUCaches(cfg.cache.size, cfg.cache.ttl)
+	return &caches
+}
+
+// newSigner returns the signer for signed tokens, or nil when AUTH_MODE is
+// stateful.
+func newSigner(cfg config) (*signedtoken.Signer, error) {
+	switch cfg.auth.mode {
+	case "stateful":
+		return nil, nil
+	case "stateless":
+		keys, err := signedtoken.ParseKeys(cfg.auth.signingKeys)
+		if err != nil {
+			return nil, fmt.Errorf("AUTH_SIGNING_KEYS: %w", err)
+		}
+
+		signer, err := signedtoken.NewSigner(keys)
+		if err != nil {
+			return nil, fmt.Errorf("AUTH_SIGNING_KEYS: %w", err)
+		}
+
+		return signer, nil
+	default:
+		return nil, fmt.Errorf("AUTH_MODE must be stateful or stateless, not %q", cfg.auth.mode)
+	}
+}
+
+// newSSO returns the OpenID Connect client, or nil when OIDC_ISSUER_URL is
+// not set.
+func newSSO(cfg config) (*sso.Client, error) {
+	if cfg.oidc.issuerURL == "" {
+		return nil, nil
+	}
+
+	if cfg.oidc.clientID == "" || cfg.oidc.redirectURL == "" {
+		return nil, errors.New("OIDC_CLIENT_ID and OIDC_REDIRECT_URL must be set with OIDC_ISSUER_URL")
+	}
+
+	client := sso.New(sso.Config{
+		IssuerURL:    cfg.oidc.issuerURL,
+		ClientID:     cfg.oidc.clientID,
+		ClientSecret: cfg.oidc.clientSecret,
+		RedirectURL:  cfg.oidc.redirectURL,
+		Scopes:       cfg.oidc.scopes,
+	})
+
+	return client, nil
+}
+
+// sqlDriver picks the database from the DSN scheme. SQLite DSNs
+// take the form sqlite://path/to/file.db.
+func sqlDriver(dsn string) (driver string, dataSource string, err error) {
+	scheme, rest, found := strings.Cut(dsn, "://")
+	if !found {
+		return "", "", errors.New("database DSN must start with a scheme such as postgres:// or sqlite://")
+	}
+
+	switch scheme {
+	case "postgres", "postgresql":
+		return "postgres", dsn, nil
+	case "sqlite":
+		pragmas := "_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_time_format=sqlite&_txlock=immediate"
+		separator := "?"
+		if strings.Contains(rest, "?") {
+			separator = "&"
+		}
+		return "sqlite", "file:" + rest + separator + pragmas, nil
+	default:
+		return "", "", fmt.Errorf("unsupported database DSN scheme %q", scheme)
+	}
+}
+
+func openDB(cfg config, dsn string) (*sql.DB, string, error) {
+	driver, dataSource, err := sqlDriver(dsn)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// Postgres is reached through pgx, which by default prepares each
+	// statement once per connection and caches it. Set
+	// default_query_exec_mode in the DSN to change that, for example to
+	// simple_protocol behind PgBouncer in transaction mode.
+	driverName := driver
+	if driver == "postgres" {
+		driverName = "pgx"
+	}
+
+	db, err := sql.Open(driverName, dataSource)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
 	db.SetMaxOpenConns(cfg.db.maxOpenConns)
@@ -118,10 +427,17 @@ func openDB(cfg config) (*sql.DB, error) {
 	err = db.PingContext(ctx)
 	if err != nil {
 		db.Close()
-		return nil, err
+		return nil, "", err
 	}
 
-	return db, nil
+	return db, driver, nil
+}
+
+func getEnvAsString(key string, defaultVal string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return defaultVal
 }
 
 func getEnvAsInt(key string, defaultVal int) int {
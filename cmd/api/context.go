@@ -2,13 +2,20 @@ package main
 
 import (
 	"autherain/golang_arxiv/internal/data"
+	"autherain/golang_arxiv/internal/signedtoken"
 	"context"
 	"net/http"
 )
 
 type contextKey string
 
-const userContextKey = contextKey("user")
+const (
+	userContextKey   = contextKey("user")
+	tokenContextKey  = contextKey("token")
+	claimsContextKey = contextKey("claims")
+	apiKeyContextKey = contextKey("apiKey")
+	movieContextKey  = contextKey("movie")
+)
 
 func (app *application) contextSetUser(r *http.Request, user *data.User) *http.Request {
 	ctx := context.WithValue(r.Context(), userContextKey, user)
@@ -23,3 +30,57 @@ func (app *application) contextGetUser(r *http.Request) *data.User {
 
 	return user
 }
+
+// contextSetToken records the authentication token the request was made
+// with, so that it can be revoked on logout.
+func (app *application) contextSetToken(r *http.Request, token string) *http.Request {
+	ctx := context.WithValue(r.Context(), tokenContextKey, token)
+	return r.WithContext(ctx)
+}
+
+func (app *application) contextGetToken(r *http.Request) string {
+	token, ok := r.Context().Value(tokenContextKey).(string)
+	if !ok {
+		panic("missing token value in request context")
+	}
+
+	return token
+}
+
+func (app *application) contextSetClaims(r *http.Request, claims *signedtoken.Claims) *http.Request {
+	ctx := context.WithValue(r.Context(), claimsContextKey, claims)
+	return r.WithContext(ctx)
+}
+
+// contextGetClaims returns the claims of the signed token the request was
+// made with, or nil if it was made with a stored token.
+func (app *application) contextGetClaims(r *http.Request) *signedtoken.Claims {
+	claims, _ := r.Context().Value(claimsContextKey).(*signedtoken.Claims)
+	return claims
+}
+
+func (app *application) contextSetAPIKey(r *http.Request, key *data.APIKey) *http.Request {
+	ctx := context.WithValue(r.Context(), apiKeyContextKey, key)
+	return r.WithContext(ctx)
+}
+
+// contextGetAPIKey returns the API key the request was made with, or nil if
+// it was made with a token.
+func (app *application) contextGetAPIKey(r *http.Request) *data.APIKey {
+	key, _ := r.Context().Value(apiKeyContextKey).(*data.APIKey)
+	return key
+}
+
+func (app *application) contextSetMovie(r *http.Request, movie *data.Movie) *http.Request {
+	ctx := context.WithValue(r.Context(), movieContextKey, movie)
+	return r.WithContext(ctx)
+}
+
+func (app *application) contextGetMovie(r *http.Request) *data.Movie {
+	movie, ok := r.Context().Value(movieContextKey).(*data.Movie)
+	if !ok {
+		panic("missing movie value in request context")
+	}
+
+	return movie
+}
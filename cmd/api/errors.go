@@ -1,6 +1,8 @@
 package main
 
 import (
+	"autherain/golang_arxiv/internal/data"
+	"errors"
 	"fmt"
 	"net/http"
 
@@ -60,6 +62,34 @@ func (app *application) editConflictResponse(w http.ResponseWriter, r *http.Requ
 	app.errorResponse(w, r, http.StatusConflict, message)
 }
 
+// dataErrorResponse reports an error from a model write. A constraint
+// violation is reported against the field it concerns, with 409 when it
+// conflicts with an existing record and 422 otherwise; anything unexpected is
+// a server error.
+func (app *application) dataErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
+	var constraintErr *data.ConstraintError
+
+	switch {
+	case errors.As(err, &constraintErr):
+		status := http.StatusUnprocessableEntity
+		if errors.Is(err, data.ErrUniqueViolation) {
+			status = http.StatusConflict
+		}
+
+		if constraintErr.Field == "" {
+			app.errorResponse(w, r, status, "the request "+constraintErr.Message)
+			return
+		}
+
+		app.errorResponse(w, r, status, map[string]string{constraintErr.Field: constraintErr.Message})
+	case errors.Is(err, data.ErrSerializationFailure):
+		message := "unable to complete the request due to a concurrent update, please try again"
+		app.errorResponse(w, r, http.StatusConflict, message)
+	default:
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
 func (app *application) rateLimitExceededResponse(w http.ResponseWriter, r *http.Request) {
 	message := "rate limit exceeded"
 	app.errorResponse(w, r, http.StatusTooManyRequests, message)
@@ -77,11 +107,23 @@ func (app *application) invalidAuthenticationTokenResponse(w http.ResponseWriter
 	app.errorResponse(w, r, http.StatusUnauthorized, message)
 }
 
+func (app *application) invalidAPIKeyResponse(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("WWW-Authenticate", "ApiKey")
+
+	message := "invalid or expired API key"
+	app.errorResponse(w, r, http.StatusUnauthorized, message)
+}
+
 func (app *application) authenticationRequiredResponse(w http.ResponseWriter, r *http.Request) {
 	message := "you must be authenticated to access this resource"
 	app.errorResponse(w, r, http.StatusUnauthorized, message)
 }
 
+func (app *application) refreshTokenRotatedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "this refresh token has just been exchanged, use the tokens issued in its place"
+	app.errorResponse(w, r, http.StatusConflict, message)
+}
+
 func (app *application) inactiveAccountResponse(w http.ResponseWriter, r *http.Request) {
 	message := "your user account must be activated to access this resource"
 	app.errorResponse(w, r, http.StatusForbidden, message)
@@ -91,3 +133,23 @@ func (app *application) notPermittedResponse(w http.ResponseWriter, r *http.Requ
 	message := "your user account doesn't have the necessary permissions to access this resource"
 	app.errorResponse(w, r, http.StatusForbidden, message)
 }
+
+func (app *application) sessionRequiredResponse(w http.ResponseWriter, r *http.Request) {
+	message := "this resource cannot be accessed with an API key"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
+func (app *application) idempotencyKeyMismatchResponse(w http.ResponseWriter, r *http.Request) {
+	message := "the idempotency key has already been used with a different request"
+	app.errorResponse(w, r, http.StatusUnprocessableEntity, message)
+}
+
+func (app *application) idempotencyKeyCompletedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "a request with this idempotency key has already been completed, and its response cannot be replayed"
+	app.errorResponse(w, r, http.StatusConflict, message)
+}
+
+func (app *application) idempotencyKeyInFlightResponse(w http.ResponseWriter, r *http.Request) {
+	message := "a request with this idempotency key is still being processed, please try again"
+	app.errorResponse(w, r, http.StatusConflict, message)
+}
@@ -25,6 +25,29 @@ func (app *application) healthcheckHandler(w http.ResponseWriter, r *http.Reques
 		},
 	}
 
+	if app.migrator != nil {
+		schemaVersion, dirty, err := app.migrator.Version(ctx)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		pools := make(map[string]any, len(app.pools))
+		for _, pool := range app.pools {
+			status := map[string]any{"healthy": pool.Healthy()}
+			if msg := pool.LastError(); msg != "" {
+				status["error"] = msg
+			}
+			pools[pool.Name] = status
+		}
+
+		env["database"] = map[string]any{
+			"schema_version": schemaVersion,
+			"dirty":          dirty,
+			"pools":          pools,
+		}
+	}
+
 	observability.AddEvent(ctx, "Ended giving info")
 
 	err := app.writeJSON(w, http.StatusOK, env, nil)
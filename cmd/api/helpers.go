@@ -10,6 +10,7 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
 )
@@ -25,6 +26,21 @@ func (app *application) readIDParam(r *http.Request) (int64, error) {
 	return id, nil
 }
 
+// namedOrIDRoute lets static paths such as /v1/movies/upcoming share a
+// position with the :id wildcard, which httprouter cannot register directly.
+func (app *application) namedOrIDRoute(named map[string]http.HandlerFunc, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		params := httprouter.ParamsFromContext(r.Context())
+
+		if fn, ok := named[params.ByName("id")]; ok {
+			fn(w, r)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
 type envelope map[string]any
 
 func (app *application) writeJSON(w http.ResponseWriter, status int, data envelope, headers http.Header) error {
@@ -135,6 +151,22 @@ func (app *application) readInt(qs url.Values, key string, defaultValue int, v *
 	return i
 }
 
+// notModifiedSince reports whether the request carries an If-Modified-Since
+// header at or after lastModified. HTTP dates have one-second resolution.
+func (app *application) notModifiedSince(r *http.Request, lastModified time.Time) bool {
+	ims := r.Header.Get("If-Modified-Since")
+	if ims == "" {
+		return false
+	}
+
+	t, err := http.ParseTime(ims)
+	if err != nil {
+		return false
+	}
+
+	return !lastModified.Truncate(time.Second).After(t)
+}
+
 func (app *application) background(fn func()) {
 	app.wg.Add(1)
 
@@ -150,3 +182,33 @@ func (app *application) background(fn func()) {
 		fn()
 	}()
 }
+
+// every runs fn on each tick of interval until the server shuts down. serve
+// waits for a run in progress, as it does for background tasks.
+func (app *application) every(interval time.Duration, fn func()) {
+	app.wg.Add(1)
+
+	go func() {
+		defer app.wg.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-app.shutdown:
+				return
+			case <-ticker.C:
+				func() {
+					defer func() {
+						if err := recover(); err != nil {
+							app.logger.Error(fmt.Sprintf("%v", err))
+						}
+					}()
+
+					fn()
+				}()
+			}
+		}
+	}()
+}
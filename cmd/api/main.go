@@ -4,7 +4,10 @@ import (
 	"autherain/golang_arxiv/internal/data"
 	"autherain/golang_arxiv/internal/logger"
 	"autherain/golang_arxiv/internal/mailer"
+	"autherain/golang_arxiv/internal/migrate"
 	"autherain/golang_arxiv/internal/observability"
+	"autherain/golang_arxiv/internal/signedtoken"
+	"autherain/golang_arxiv/internal/sso"
 	"autherain/golang_arxiv/internal/vcs"
 	"flag"
 	"fmt"
@@ -14,10 +17,11 @@ import (
 
 	_ "net/http/pprof"
 
+	_ "github.com/jackc/pgx/v5/stdlib"
 	"github.com/joho/godotenv"
-	_ "github.com/lib/pq"
 	"github.com/uptrace/opentelemetry-go-extra/otelzap"
 	"go.uber.org/zap"
+	_ "modernc.org/sqlite"
 )
 
 var version = vcs.Version()
@@ -26,9 +30,23 @@ type application struct {
 	config    config
 	logger    *otelzap.Logger
 	models    data.Models
+	migrator  *migrate.Migrator
+	pools     []*data.Pool
 	mailer    mailer.Mailer
 	wg        sync.WaitGroup
 	telemetry observability.ObservabilityShutdownFunc
+
+	// sessionTouches throttles recording the use of authentication tokens.
+	sessionTouches *sessionTouches
+	// signer issues and verifies signed tokens; it is nil unless AUTH_MODE
+	// is stateless.
+	signer *signedtoken.Signer
+	// sso runs OpenID Connect logins; it is nil unless OIDC_ISSUER_URL is
+	// set.
+	sso *sso.Client
+	// shutdown is closed when the server begins shutting down, to stop the
+	// tasks started with every.
+	shutdown chan struct{}
 }
 
 func main() {
@@ -46,6 +64,24 @@ func main() {
 		os.Exit(0)
 	}
 
+	if flag.Arg(0) == "migrate" {
+		err := runMigrate(cfg, flag.Args()[1:])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "migrate: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if flag.Arg(0) == "seed" {
+		err := runSeed(cfg, flag.Args()[1:])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "seed: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	logConfig := logger.Config{
 		Environment:    cfg.env,
 		LogLevel:       cfg.logger.logLevel,       // or get from your config
@@ -68,19 +104,38 @@ func main() {
 	logger := otelzap.New(zapLogger)
 	otelzap.ReplaceGlobals(logger)
 
-	db, err := openDB(cfg)
+	signer, err := newSigner(cfg)
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+
+	ssoClient, err := newSSO(cfg)
 	if err != nil {
 		logger.Error(err.Error())
 		os.Exit(1)
 	}
-	defer db.Close()
-	logger.Info("database connection pool established")
+
+	storage, err := openStorage(cfg, logger)
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+	defer storage.close()
+	logger.Info("storage backend ready", zap.String("backend", cfg.storage.backend))
 
 	app := &application{
-		config: cfg,
-		logger: logger,
-		models: data.NewModels(db),
-		mailer: mailer.New(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password, cfg.smtp.sender),
+		config:   cfg,
+		logger:   logger,
+		models:   storage.models,
+		migrator: storage.migrator,
+		pools:    storage.pools,
+		mailer:   mailer.New(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password, cfg.smtp.sender),
+
+		sessionTouches: newSessionTouches(cfg.sessions.touchInterval),
+		signer:         signer,
+		sso:            ssoClient,
+		shutdown:       make(chan struct{}),
 	}
 
 	telemetry, err := observability.InitTelemetry(cfg.serviceName,
@@ -95,6 +150,12 @@ func main() {
 	}
 	defer telemetry()
 
+	app.monitorPools(poolCheckInterval)
+	app.pruneIdempotencyKeys(purgeInterval)
+	app.purgeDeletedUsers(purgeInterval)
+	app.pruneDenylist(purgeInterval)
+	app.pruneOIDCLogins(purgeInterval)
+
 	err = app.serve()
 	if err != nil {
 		logger.Error(err.Error())
@@ -3,10 +3,16 @@ package main
 import (
 	"autherain/golang_arxiv/internal/data"
 	"autherain/golang_arxiv/internal/observability"
+	"autherain/golang_arxiv/internal/signedtoken"
 	"autherain/golang_arxiv/internal/validator"
+	"bytes"
+	"context"
+	"crypto/sha256"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -101,6 +107,23 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 		}
 
 		headerParts := strings.Split(authorizationHeader, " ")
+
+		if len(headerParts) == 2 && headerParts[0] == "ApiKey" {
+			authenticated, err := app.authenticateAPIKey(r, headerParts[1])
+			if err != nil {
+				switch {
+				case errors.Is(err, data.ErrRecordNotFound):
+					app.invalidAPIKeyResponse(w, r)
+				default:
+					app.serverErrorResponse(w, r, err)
+				}
+				return
+			}
+
+			next.ServeHTTP(w, authenticated)
+			return
+		}
+
 		if len(headerParts) != 2 || headerParts[0] != "Bearer" {
 			app.invalidAuthenticationTokenResponse(w, r)
 			return
@@ -108,6 +131,22 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 
 		token := headerParts[1]
 
+		if app.signer != nil && signedtoken.LooksSigned(token) {
+			signed, err := app.authenticateSigned(r, token)
+			if err != nil {
+				switch {
+				case errors.Is(err, signedtoken.ErrInvalidToken):
+					app.invalidAuthenticationTokenResponse(w, r)
+				default:
+					app.serverErrorResponse(w, r, err)
+				}
+				return
+			}
+
+			next.ServeHTTP(w, app.contextSetToken(signed, token))
+			return
+		}
+
 		v := validator.New()
 
 		if data.ValidateTokenPlaintext(v, token); !v.Valid() {
@@ -115,7 +154,7 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 			return
 		}
 
-		user, err := app.models.Users.GetForToken(data.ScopeAuthentication, token)
+		user, err := app.models.Users.GetForToken(r.Context(), data.ScopeAuthentication, token)
 		if err != nil {
 			switch {
 			case errors.Is(err, data.ErrRecordNotFound):
@@ -127,11 +166,123 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 		}
 
 		r = app.contextSetUser(r, user)
+		r = app.contextSetToken(r, token)
+
+		app.touchSession(r, token)
 
 		next.ServeHTTP(w, r)
 	})
 }
 
+// lastWriteCookie carries the time of a user's last write, in Unix
+// milliseconds, so that another API process serving their next request knows
+// to read from the primary too. Clients without a cookie jar rely on the
+// process's own record of their writes.
+const lastWriteCookie = "last_write"
+
+// readYourWrites sends the reads of a user who has written within the
+// configured window to the primary, so that they see their own changes
+// before the replicas have caught up. Requests that may write are sent to the
+// primary too and restart the window.
+func (app *application) readYourWrites(next http.Handler) http.Handler {
+	window := app.config.db.readYourWritesWindow
+
+	if len(app.pools) < 2 || window <= 0 {
+		return next
+	}
+
+	lastWrites := newWriteLog(window)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := app.contextGetUser(r)
+
+		if user.IsAnonymous() {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		writes := r.Method != http.MethodGet && r.Method != http.MethodHead && r.Method != http.MethodOptions
+
+		if writes {
+			http.SetCookie(w, &http.Cookie{
+				Name:     lastWriteCookie,
+				Value:    strconv.FormatInt(time.Now().UnixMilli(), 10),
+				Path:     "/",
+				MaxAge:   int(window.Seconds()) + 1,
+				HttpOnly: true,
+				SameSite: http.SameSiteLaxMode,
+			})
+		}
+
+		if writes || lastWrites.recent(user.ID, time.Now()) || app.wroteRecently(r, window) {
+			r = r.WithContext(data.WithPrimary(r.Context()))
+		}
+
+		next.ServeHTTP(w, r)
+
+		if writes {
+			lastWrites.record(user.ID, time.Now())
+		}
+	})
+}
+
+// writeLog records when each user last wrote through this process. Entries
+// are only needed for one window, so they are swept whenever the map has
+// grown, as sessionTouches does, rather than on a timer.
+type writeLog struct {
+	mu     sync.Mutex
+	window time.Duration
+	last   map[int64]time.Time
+}
+
+func newWriteLog(window time.Duration) *writeLog {
+	return &writeLog{window: window, last: make(map[int64]time.Time)}
+}
+
+func (l *writeLog) recent(userID int64, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	last, ok := l.last[userID]
+
+	return ok && now.Sub(last) <= l.window
+}
+
+func (l *writeLog) record(userID int64, now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.last) >= 10_000 {
+		for id, last := range l.last {
+			if now.Sub(last) > l.window {
+				delete(l.last, id)
+			}
+		}
+	}
+
+	l.last[userID] = now
+}
+
+// wroteRecently reports whether the request carries a last write cookie
+// within window.
+func (app *application) wroteRecently(r *http.Request, window time.Duration) bool {
+	cookie, err := r.Cookie(lastWriteCookie)
+	if err != nil {
+		return false
+	}
+
+	millis, err := strconv.ParseInt(cookie.Value, 10, 64)
+	if err != nil {
+		return false
+	}
+
+	// The clocks of the API processes may differ a little, but a time
+	// further ahead than that would keep the user on the primary.
+	age := time.Since(time.UnixMilli(millis))
+
+	return age >= -window && age <= window
+}
+
 func (app *application) requireAuthenticatedUser(next http.HandlerFunc) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		user := app.contextGetUser(r)
@@ -160,11 +311,62 @@ func (app *application) requireActivatedUser(next http.HandlerFunc) http.Handler
 	return app.requireAuthenticatedUser(fn)
 }
 
-func (app *application) requirePermission(code string, next http.HandlerFunc) http.HandlerFunc {
+var errNotPermitted = errors.New("not permitted")
+
+// requireSession rejects requests made with an API key, for the routes that
+// manage the account and its credentials.
+func (app *application) requireSession(next http.HandlerFunc) http.HandlerFunc {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		if app.contextGetAPIKey(r) != nil {
+			app.sessionRequiredResponse(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	}
+
+	return app.requireAuthenticatedUser(fn)
+}
+
+// userPermissions returns the permissions the request was authenticated
+// with: those carried by a signed token, those of an API key that its owner
+// still holds, or else those stored for the user.
+func (app *application) userPermissions(r *http.Request, user *data.User) (data.Permissions, error) {
+	if claims := app.contextGetClaims(r); claims != nil {
+		return data.Permissions(claims.Permissions), nil
+	}
+
+	granted, err := app.models.Permissions.GetAllForUser(r.Context(), user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	key := app.contextGetAPIKey(r)
+	if key == nil {
+		return granted, nil
+	}
+
+	var permissions data.Permissions
+
+	for _, code := range key.Permissions {
+		if granted.Include(code) {
+			permissions = append(permissions, code)
+		}
+	}
+
+	return permissions, nil
+}
+
+// resourcePolicy is a resource-level check run by requirePermission once the
+// permission code has been granted. It may return a request carrying whatever
+// it loaded, errNotPermitted to deny access, or data.ErrRecordNotFound.
+type resourcePolicy func(r *http.Request, user *data.User, permissions data.Permissions) (*http.Request, error)
+
+func (app *application) requirePermission(code string, next http.HandlerFunc, policies ...resourcePolicy) http.HandlerFunc {
 	fn := func(w http.ResponseWriter, r *http.Request) {
 		user := app.contextGetUser(r)
 
-		permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+		permissions, err := app.userPermissions(r, user)
 		if err != nil {
 			app.serverErrorResponse(w, r, err)
 			return
@@ -175,12 +377,47 @@ func (app *application) requirePermission(code string, next http.HandlerFunc) ht
 			return
 		}
 
+		for _, policy := range policies {
+			r, err = policy(r, user, permissions)
+			if err != nil {
+				switch {
+				case errors.Is(err, errNotPermitted):
+					app.notPermittedResponse(w, r)
+				case errors.Is(err, data.ErrRecordNotFound):
+					app.notFoundResponse(w, r)
+				default:
+					app.serverErrorResponse(w, r, err)
+				}
+				return
+			}
+		}
+
 		next.ServeHTTP(w, r)
 	}
 
 	return app.requireActivatedUser(fn)
 }
 
+// movieOwnerPolicy allows the movie's creator or holders of movies:admin to
+// act on it, and stores the loaded movie in the request context.
+func (app *application) movieOwnerPolicy(r *http.Request, user *data.User, permissions data.Permissions) (*http.Request, error) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		return r, data.ErrRecordNotFound
+	}
+
+	movie, err := app.models.Movies.Get(r.Context(), id)
+	if err != nil {
+		return r, err
+	}
+
+	if !movie.OwnedBy(user.ID) && !permissions.Include("movies:admin") {
+		return r, errNotPermitted
+	}
+
+	return app.contextSetMovie(r, movie), nil
+}
+
 func (app *application) enableCORS(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		_, span := observability.StartSpan(r.Context(), "middlewareEnableCors")
@@ -200,7 +437,7 @@ func (app *application) enableCORS(next http.Handler) http.Handler {
 					if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
 
 						w.Header().Set("Access-Control-Allow-Methods", "OPTIONS, PUT, PATCH, DELETE")
-						w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+						w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, Idempotency-Key")
 
 						w.WriteHeader(http.StatusOK)
 						return
@@ -214,3 +451,153 @@ func (app *application) enableCORS(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r)
 	})
 }
+
+type idempotencyRecorder struct {
+	http.ResponseWriter
+	statusCode int
+	body       bytes.Buffer
+}
+
+func (rec *idempotencyRecorder) WriteHeader(statusCode int) {
+	if rec.statusCode == 0 {
+		rec.statusCode = statusCode
+	}
+
+	rec.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (rec *idempotencyRecorder) Write(b []byte) (int, error) {
+	if rec.statusCode == 0 {
+		rec.statusCode = http.StatusOK
+	}
+
+	rec.body.Write(b)
+
+	return rec.ResponseWriter.Write(b)
+}
+
+// idempotent replays the stored response for a repeated Idempotency-Key.
+// Keys are scoped to the authenticated user; anonymous requests share one
+// user ID, so their keys are also scoped to the client IP address.
+func (app *application) idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return app.idempotency(next, true)
+}
+
+// idempotentWithoutReplay honours Idempotency-Key for handlers whose
+// responses carry tokens or keys, which must not be stored. Only the outcome
+// of a successful request is kept, and a repeat of it is refused with 409
+// Conflict instead of being replayed; a failed request may be retried.
+func (app *application) idempotentWithoutReplay(next http.HandlerFunc) http.HandlerFunc {
+	return app.idempotency(next, false)
+}
+
+func (app *application) idempotency(next http.HandlerFunc, replay bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		v := validator.New()
+
+		if data.ValidateIdempotencyKey(v, key); !v.Valid() {
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1_048_576))
+		if err != nil {
+			app.badRequestResponse(w, r, err)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		fingerprint := sha256.New()
+		fingerprint.Write([]byte(r.Method + " " + r.URL.Path + "\n"))
+		fingerprint.Write(body)
+
+		user := app.contextGetUser(r)
+		if user.IsAnonymous() {
+			key = realip.FromRequest(r) + " " + key
+		}
+
+		stored, err := app.models.Idempotency.Begin(r.Context(), user.ID, key, fingerprint.Sum(nil), 24*time.Hour)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrIdempotencyKeyMismatch):
+				app.idempotencyKeyMismatchResponse(w, r)
+			case errors.Is(err, data.ErrIdempotencyKeyInFlight):
+				app.idempotencyKeyInFlightResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		if stored != nil && !replay {
+			app.idempotencyKeyCompletedResponse(w, r)
+			return
+		}
+
+		if stored != nil {
+			for key, value := range stored.Header {
+				w.Header()[key] = value
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(stored.StatusCode)
+			w.Write(stored.Body)
+			return
+		}
+
+		rec := &idempotencyRecorder{ResponseWriter: w}
+
+		completed := false
+
+		defer func() {
+			if completed {
+				return
+			}
+
+			err := app.models.Idempotency.Release(context.WithoutCancel(r.Context()), user.ID, key)
+			if err != nil {
+				app.logError(r, err)
+			}
+		}()
+
+		next.ServeHTTP(rec, r)
+
+		if rec.statusCode >= http.StatusInternalServerError || (!replay && rec.statusCode >= http.StatusBadRequest) {
+			return
+		}
+
+		response := &data.IdempotentResponse{StatusCode: rec.statusCode}
+		if replay {
+			response.Header = w.Header().Clone()
+			response.Body = rec.body.Bytes()
+		}
+
+		// The response has already been sent, so store it even if the client
+		// has gone away in the meantime.
+		err = app.models.Idempotency.Complete(context.WithoutCancel(r.Context()), user.ID, key, response)
+		if err != nil {
+			app.logError(r, err)
+			return
+		}
+
+		completed = true
+	}
+}
+
+// pruneIdempotencyKeys deletes expired idempotency keys on an interval.
+func (app *application) pruneIdempotencyKeys(interval time.Duration) {
+	app.every(interval, func() {
+		ctx, cancel := context.WithTimeout(context.Background(), purgeTimeout)
+		defer cancel()
+
+		err := app.models.Idempotency.DeleteExpired(ctx)
+		if err != nil {
+			app.logger.Error(err.Error())
+		}
+	})
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"autherain/golang_arxiv/internal/migrate"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+)
+
+const migrateUsage = "usage: api migrate up | down [N] | status | goto V"
+
+// runMigrate implements the migrate subcommand against the database named by
+// the configuration, whatever the storage backend is set to.
+func runMigrate(cfg config, args []string) error {
+	if len(args) == 0 {
+		return errors.New(migrateUsage)
+	}
+
+	db, driver, err := openDB(cfg, cfg.db.dsn)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	migrator, err := migrate.New(db, driver)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+
+	switch {
+	case args[0] == "up" && len(args) == 1:
+		err = migrator.Up(ctx)
+	case args[0] == "down" && len(args) <= 2:
+		steps := 1
+		if len(args) == 2 {
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps < 1 {
+				return fmt.Errorf("invalid number of steps %q", args[1])
+			}
+		}
+		err = migrator.Down(ctx, steps)
+	case args[0] == "goto" && len(args) == 2:
+		version, perr := strconv.ParseUint(args[1], 10, 64)
+		if perr != nil {
+			return fmt.Errorf("invalid version %q", args[1])
+		}
+		err = migrator.Goto(ctx, uint(version))
+	case args[0] == "status" && len(args) == 1:
+		return printMigrateStatus(ctx, migrator)
+	default:
+		return errors.New(migrateUsage)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return printMigrateStatus(ctx, migrator)
+}
+
+func printMigrateStatus(ctx context.Context, migrator *migrate.Migrator) error {
+	status, err := migrator.Status(ctx)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("version: %d (latest %d)\n", status.Version, migrator.Latest())
+	if status.Dirty {
+		fmt.Println("dirty: true")
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+
+	for _, m := range status.Migrations {
+		state := "pending"
+		if m.Version <= status.Version {
+			state = "applied"
+		}
+
+		fmt.Fprintf(tw, "%06d\t%s\t%s\n", m.Version, m.Name, state)
+	}
+
+	return tw.Flush()
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"autherain/golang_arxiv/internal/data"
+	"autherain/golang_arxiv/internal/sso"
+	"autherain/golang_arxiv/internal/validator"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// oidcLoginTTL is how long the user has to sign in at the provider.
+const oidcLoginTTL = 10 * time.Minute
+
+var (
+	errOIDCEmailUnverified    = errors.New("email not verified by the identity provider")
+	errOIDCAccountInactive    = errors.New("account with this email is not activated")
+	errOIDCLoginSecretMissing = errors.New("login secret not provided")
+	errOIDCIdentityNotLinked  = errors.New("identity not linked to the user")
+)
+
+// oidcCallback is what the client posts back to finish a login: the code and
+// state the provider returned the user with, and the secret the login was
+// started with.
+type oidcCallback struct {
+	Code        string `json:"code"`
+	State       string `json:"state"`
+	LoginSecret string `json:"login_secret"`
+}
+
+func validateOIDCCallback(v *validator.Validator, callback *oidcCallback) {
+	v.Check(callback.Code != "", "code", "must be provided")
+	v.Check(callback.State != "", "state", "must be provided")
+}
+
+// createOIDCLoginHandler starts an OpenID Connect login and returns the
+// provider URL to send the user to, along with a login secret the client must
+// send back with the code. The state and code travel through the user's
+// browser and may leak from it, but without the secret they cannot be used to
+// complete the login.
+func (app *application) createOIDCLoginHandler(w http.ResponseWriter, r *http.Request) {
+	login, authorizationURL, err := app.sso.Begin(r.Context())
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	secret, err := randomSecret()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.OIDCLogins.Insert(r.Context(), &data.OIDCLogin{
+		State:      login.State,
+		Nonce:      login.Nonce,
+		Verifier:   login.Verifier,
+		SecretHash: oidcSecretHash(secret),
+		Expiry:     time.Now().Add(oidcLoginTTL),
+	})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelope{"authorization_url": authorizationURL, "login_secret": secret}
+
+	err = app.writeJSON(w, http.StatusCreated, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// completeOIDCLoginHandler finishes a login and logs the user in as
+// createAuthenticationTokenHandler does.
+func (app *application) completeOIDCLoginHandler(w http.ResponseWriter, r *http.Request) {
+	var input oidcCallback
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if validateOIDCCallback(v, &input); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	identity, err := app.finishOIDCLogin(r.Context(), &input)
+	if err != nil {
+		app.oidcLoginErrorResponse(w, r, err)
+		return
+	}
+
+	family, err := data.NewTokenFamily()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	var token, refreshToken *data.Token
+
+	err = app.models.WithTx(r.Context(), func(tx data.Models) error {
+		user, err := app.oidcUser(r.Context(), tx, identity)
+		if err != nil {
+			return err
+		}
+
+		err = app.restoreAccount(r.Context(), tx, user)
+		if err != nil {
+			return err
+		}
+
+		token, refreshToken, err = app.issueSessionTokens(r, tx, user, family)
+		return err
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, errOIDCEmailUnverified):
+			v.AddError("email", "must be a valid address verified by the identity provider")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, errOIDCAccountInactive):
+			v.AddError("email", "the account with this email address must be activated before signing in with it")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.dataErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	env := envelope{"authentication_token": token, "refresh_token": refreshToken}
+
+	err = app.writeJSON(w, http.StatusCreated, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// finishOIDCLogin takes the login the callback belongs to and exchanges its
+// code for the identity the user signed in as.
+func (app *application) finishOIDCLogin(ctx context.Context, callback *oidcCallback) (*sso.Identity, error) {
+	if callback.LoginSecret == "" {
+		return nil, errOIDCLoginSecretMissing
+	}
+
+	login, err := app.models.OIDCLogins.Take(ctx, callback.State, oidcSecretHash(callback.LoginSecret))
+	if err != nil {
+		return nil, err
+	}
+
+	return app.sso.Exchange(ctx, &sso.Login{State: login.State, Nonce: login.Nonce, Verifier: login.Verifier}, callback.Code)
+}
+
+// confirmOIDCIdentity finishes a login, which must be as an identity linked
+// to user. It stands in for the password of users who only sign in through
+// a provider.
+func (app *application) confirmOIDCIdentity(ctx context.Context, user *data.User, callback *oidcCallback) error {
+	identity, err := app.finishOIDCLogin(ctx, callback)
+	if err != nil {
+		return err
+	}
+
+	linked, err := app.models.Identities.Get(ctx, identity.Issuer, identity.Subject)
+	switch {
+	case errors.Is(err, data.ErrRecordNotFound):
+		return errOIDCIdentityNotLinked
+	case err != nil:
+		return err
+	case linked.UserID != user.ID:
+		return errOIDCIdentityNotLinked
+	}
+
+	return nil
+}
+
+// oidcLoginErrorResponse responds to an error from finishOIDCLogin or
+// confirmOIDCIdentity.
+func (app *application) oidcLoginErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
+	v := validator.New()
+
+	switch {
+	case errors.Is(err, errOIDCLoginSecretMissing), errors.Is(err, sso.ErrInvalidLogin):
+		app.invalidCredentialsResponse(w, r)
+	case errors.Is(err, data.ErrRecordNotFound):
+		v.AddError("state", "invalid or expired login")
+		app.failedValidationResponse(w, r, v.Errors)
+	case errors.Is(err, errOIDCIdentityNotLinked):
+		v.AddError("oidc", "must be a login as an identity linked to this account")
+		app.failedValidationResponse(w, r, v.Errors)
+	default:
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// oidcUser returns the user signing in as identity. An identity seen before
+// signs in as the user it was linked to. A new one is linked to the user
+// with its email, which the provider must have verified, or to a user
+// created for it with the default permissions.
+func (app *application) oidcUser(ctx context.Context, models data.Models, identity *sso.Identity) (*data.User, error) {
+	linked, err := models.Identities.Get(ctx, identity.Issuer, identity.Subject)
+	switch {
+	case err == nil:
+		return models.Users.Get(ctx, linked.UserID)
+	case !errors.Is(err, data.ErrRecordNotFound):
+		return nil, err
+	}
+
+	if !identity.EmailVerified || !validator.Matches(identity.Email, validator.EmailRX) {
+		return nil, errOIDCEmailUnverified
+	}
+
+	user, err := models.Users.GetByEmail(ctx, identity.Email)
+	switch {
+	case err == nil:
+		// Anyone can register an email address they do not own, so an
+		// account that was never activated is not linked: its owner
+		// would keep access through the password.
+		if !user.Activated {
+			return nil, errOIDCAccountInactive
+		}
+	case errors.Is(err, data.ErrRecordNotFound):
+		user, err = app.insertOIDCUser(ctx, models, identity)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, err
+	}
+
+	err = models.Identities.Insert(ctx, &data.Identity{Issuer: identity.Issuer, Subject: identity.Subject, UserID: user.ID})
+	if err != nil {
+		return nil, err
+	}
+
+	err = models.Audit.Insert(ctx, &data.AuditEntry{UserID: user.ID, Action: data.AuditIdentityLinked})
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// insertOIDCUser creates an activated user for identity. The password is
+// random, so it can only be used after a password reset; until then the user
+// confirms deleting their account with a fresh login at the provider instead.
+func (app *application) insertOIDCUser(ctx context.Context, models data.Models, identity *sso.Identity) (*data.User, error) {
+	name := strings.TrimSpace(identity.Name)
+	if name == "" || len(name) > 500 {
+		name = identity.Email
+	}
+
+	user := &data.User{
+		Name:      name,
+		Email:     identity.Email,
+		Activated: true,
+	}
+
+	password, err := randomSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	err = user.Password.Set(password)
+	if err != nil {
+		return nil, err
+	}
+
+	err = models.Users.Insert(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+
+	err = models.Permissions.AddForUser(ctx, user.ID, app.config.oidc.defaultPermissions...)
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// randomSecret returns 32 random bytes, base64 encoded.
+func randomSecret() (string, error) {
+	randomBytes := make([]byte, 32)
+
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(randomBytes), nil
+}
+
+func oidcSecretHash(secret string) []byte {
+	hash := sha256.Sum256([]byte(secret))
+	return hash[:]
+}
+
+// pruneOIDCLogins deletes, on an interval, the logins that were started but
+// never completed.
+func (app *application) pruneOIDCLogins(interval time.Duration) {
+	if app.sso == nil {
+		return
+	}
+
+	app.every(interval, func() {
+		ctx, cancel := context.WithTimeout(context.Background(), purgeTimeout)
+		defer cancel()
+
+		err := app.models.OIDCLogins.DeleteExpired(ctx)
+		if err != nil {
+			app.logger.Error("failed to prune OpenID Connect logins", zap.Error(err))
+		}
+	})
+}
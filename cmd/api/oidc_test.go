@@ -0,0 +1,435 @@
+package main
+
+import (
+	"autherain/golang_arxiv/internal/data"
+	"autherain/golang_arxiv/internal/sso/ssotest"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/uptrace/opentelemetry-go-extra/otelzap"
+	"go.uber.org/zap"
+)
+
+// newOIDCTestApplication returns an application on the memory backend that
+// signs users in through a test provider.
+func newOIDCTestApplication(t *testing.T) (*application, *ssotest.Provider) {
+	t.Helper()
+
+	provider, err := ssotest.NewProvider("client", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(provider.Close)
+
+	var cfg config
+	cfg.auth.accessTokenTTL = 15 * time.Minute
+	cfg.auth.refreshTokenTTL = 24 * time.Hour
+	cfg.sessions.touchInterval = time.Minute
+	cfg.oidc.issuerURL = provider.URL
+	cfg.oidc.clientID = "client"
+	cfg.oidc.clientSecret = "secret"
+	cfg.oidc.redirectURL = "https://app.example.com/callback"
+	cfg.oidc.scopes = []string{"openid", "email", "profile"}
+	cfg.oidc.defaultPermissions = []string{"movies:read", "movies:write"}
+
+	ssoClient, err := newSSO(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := &application{
+		config:         cfg,
+		logger:         otelzap.New(zap.NewNop()),
+		models:         data.NewMemoryModels(),
+		sessionTouches: newSessionTouches(cfg.sessions.touchInterval),
+		sso:            ssoClient,
+		shutdown:       make(chan struct{}),
+	}
+
+	return app, provider
+}
+
+func postJSON(t *testing.T, handler http.Handler, path string, body any) (int, map[string]any) {
+	t.Helper()
+
+	return requestJSON(t, handler, http.MethodPost, path, "", body)
+}
+
+// requestJSON sends body to path, authenticated with token unless it is
+// empty, and returns the decoded response.
+func requestJSON(t *testing.T, handler http.Handler, method, path, token string, body any) (int, map[string]any) {
+	t.Helper()
+
+	js, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(method, path, bytes.NewReader(js))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	var response map[string]any
+
+	err = json.Unmarshal(rr.Body.Bytes(), &response)
+	if err != nil {
+		t.Fatalf("%s: %v in response %q", path, err, rr.Body.String())
+	}
+
+	return rr.Code, response
+}
+
+// oidcLogin is what a client posts back to complete a login.
+type oidcLogin struct {
+	State       string `json:"state"`
+	Code        string `json:"code"`
+	LoginSecret string `json:"login_secret"`
+}
+
+// startOIDCLogin starts a login and has the provider authorize it with
+// claims, returning what the client would post back.
+func startOIDCLogin(t *testing.T, handler http.Handler, provider *ssotest.Provider, claims map[string]any) oidcLogin {
+	t.Helper()
+
+	status, response := postJSON(t, handler, "/v1/tokens/oidc", nil)
+	if status != http.StatusCreated {
+		t.Fatalf("got status %d starting login; want %d", status, http.StatusCreated)
+	}
+
+	authorizationURL, _ := response["authorization_url"].(string)
+	secret, _ := response["login_secret"].(string)
+	if secret == "" {
+		t.Fatalf("got response %v starting login; want a login secret", response)
+	}
+
+	code, err := provider.Authorize(authorizationURL, claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, authorizationURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return oidcLogin{State: req.URL.Query().Get("state"), Code: code, LoginSecret: secret}
+}
+
+func completeOIDCLogin(t *testing.T, handler http.Handler, login oidcLogin) (int, map[string]any) {
+	t.Helper()
+
+	return postJSON(t, handler, "/v1/tokens/oidc/callback", login)
+}
+
+func insertTestUser(t *testing.T, models data.Models, email string, activated bool) *data.User {
+	t.Helper()
+
+	user := &data.User{Name: "Existing", Email: email, Activated: activated}
+
+	err := user.Password.Set("pa55word1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = models.Users.Insert(context.Background(), user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return user
+}
+
+func TestCompleteOIDCLoginCreatesUser(t *testing.T) {
+	app, provider := newOIDCTestApplication(t)
+	handler := app.routes()
+
+	login := startOIDCLogin(t, handler, provider, map[string]any{
+		"sub":            "alice",
+		"email":          "alice@example.com",
+		"email_verified": true,
+		"name":           "Alice",
+	})
+
+	status, response := completeOIDCLogin(t, handler, login)
+	if status != http.StatusCreated {
+		t.Fatalf("got status %d; want %d: %v", status, http.StatusCreated, response)
+	}
+	if response["authentication_token"] == nil || response["refresh_token"] == nil {
+		t.Errorf("got response %v; want authentication and refresh tokens", response)
+	}
+
+	ctx := context.Background()
+
+	user, err := app.models.Users.GetByEmail(ctx, "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !user.Activated || user.Name != "Alice" {
+		t.Errorf("got user %+v; want activated user named Alice", user)
+	}
+
+	permissions, err := app.models.Permissions.GetAllForUser(ctx, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(permissions)
+	if !slices.Equal(permissions, app.config.oidc.defaultPermissions) {
+		t.Errorf("got permissions %v; want %v", permissions, app.config.oidc.defaultPermissions)
+	}
+
+	identity, err := app.models.Identities.Get(ctx, provider.URL, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.UserID != user.ID {
+		t.Errorf("got identity linked to user %d; want %d", identity.UserID, user.ID)
+	}
+
+	verifiers := provider.Verifiers()
+	if len(verifiers) != 1 || verifiers[0] == "" {
+		t.Errorf("got verifiers %q sent on exchange; want one", verifiers)
+	}
+}
+
+func TestCompleteOIDCLoginLinksExistingUser(t *testing.T) {
+	tests := []struct {
+		name          string
+		activated     bool
+		emailVerified bool
+		wantStatus    int
+	}{
+		{name: "verified email, activated account", activated: true, emailVerified: true, wantStatus: http.StatusCreated},
+		{name: "unverified email", activated: true, emailVerified: false, wantStatus: http.StatusUnprocessableEntity},
+		{name: "account not activated", activated: false, emailVerified: true, wantStatus: http.StatusUnprocessableEntity},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app, provider := newOIDCTestApplication(t)
+			handler := app.routes()
+
+			user := insertTestUser(t, app.models, "bob@example.com", tt.activated)
+
+			login := startOIDCLogin(t, handler, provider, map[string]any{
+				"sub":            "bob",
+				"email":          "bob@example.com",
+				"email_verified": tt.emailVerified,
+			})
+
+			status, response := completeOIDCLogin(t, handler, login)
+			if status != tt.wantStatus {
+				t.Fatalf("got status %d; want %d: %v", status, tt.wantStatus, response)
+			}
+
+			identity, err := app.models.Identities.Get(context.Background(), provider.URL, "bob")
+
+			switch {
+			case tt.wantStatus == http.StatusCreated && err != nil:
+				t.Fatalf("identity not linked: %v", err)
+			case tt.wantStatus == http.StatusCreated && identity.UserID != user.ID:
+				t.Errorf("got identity linked to user %d; want %d", identity.UserID, user.ID)
+			case tt.wantStatus != http.StatusCreated && !errors.Is(err, data.ErrRecordNotFound):
+				t.Errorf("got identity %+v, error %v; want none linked", identity, err)
+			}
+		})
+	}
+}
+
+func TestCompleteOIDCLoginRejectsState(t *testing.T) {
+	claims := map[string]any{"sub": "carol", "email": "carol@example.com", "email_verified": true}
+
+	t.Run("expired", func(t *testing.T) {
+		app, provider := newOIDCTestApplication(t)
+		handler := app.routes()
+
+		login := startOIDCLogin(t, handler, provider, claims)
+
+		err := app.models.OIDCLogins.Insert(context.Background(), &data.OIDCLogin{
+			State:      "expired-state",
+			Nonce:      "nonce",
+			Verifier:   "verifier",
+			SecretHash: oidcSecretHash(login.LoginSecret),
+			Expiry:     time.Now().Add(-time.Minute),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		login.State = "expired-state"
+
+		status, response := completeOIDCLogin(t, handler, login)
+		if status != http.StatusUnprocessableEntity {
+			t.Errorf("got status %d; want %d: %v", status, http.StatusUnprocessableEntity, response)
+		}
+	})
+
+	t.Run("reused", func(t *testing.T) {
+		app, provider := newOIDCTestApplication(t)
+		handler := app.routes()
+
+		login := startOIDCLogin(t, handler, provider, claims)
+
+		status, response := completeOIDCLogin(t, handler, login)
+		if status != http.StatusCreated {
+			t.Fatalf("got status %d; want %d: %v", status, http.StatusCreated, response)
+		}
+
+		status, response = completeOIDCLogin(t, handler, login)
+		if status != http.StatusUnprocessableEntity {
+			t.Errorf("got status %d reusing state; want %d: %v", status, http.StatusUnprocessableEntity, response)
+		}
+	})
+}
+
+func TestCompleteOIDCLoginRequiresLoginSecret(t *testing.T) {
+	app, provider := newOIDCTestApplication(t)
+	handler := app.routes()
+
+	claims := map[string]any{"sub": "erin", "email": "erin@example.com", "email_verified": true}
+
+	login := startOIDCLogin(t, handler, provider, claims)
+	other := startOIDCLogin(t, handler, provider, claims)
+
+	replayed := login
+	replayed.LoginSecret = ""
+
+	status, response := completeOIDCLogin(t, handler, replayed)
+	if status != http.StatusUnauthorized {
+		t.Errorf("got status %d without the login secret; want %d: %v", status, http.StatusUnauthorized, response)
+	}
+
+	replayed.LoginSecret = other.LoginSecret
+
+	status, response = completeOIDCLogin(t, handler, replayed)
+	if status != http.StatusUnprocessableEntity {
+		t.Errorf("got status %d with another login's secret; want %d: %v", status, http.StatusUnprocessableEntity, response)
+	}
+
+	_, err := app.models.Users.GetByEmail(context.Background(), "erin@example.com")
+	if !errors.Is(err, data.ErrRecordNotFound) {
+		t.Fatalf("got error %v looking up the user; want none created", err)
+	}
+
+	// The attempts leave the login for the client that started it.
+	status, response = completeOIDCLogin(t, handler, login)
+	if status != http.StatusCreated {
+		t.Errorf("got status %d with the login secret; want %d: %v", status, http.StatusCreated, response)
+	}
+}
+
+func TestCompleteOIDCLoginRejectsInvalidIDToken(t *testing.T) {
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		claims map[string]any
+		setup  func(provider *ssotest.Provider)
+	}{
+		{
+			name:   "nonce mismatch",
+			claims: map[string]any{"nonce": "another login's nonce"},
+		},
+		{
+			name:  "bad signature",
+			setup: func(provider *ssotest.Provider) { provider.SignWith(otherKey) },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app, provider := newOIDCTestApplication(t)
+			handler := app.routes()
+
+			claims := map[string]any{"sub": "dave", "email": "dave@example.com", "email_verified": true}
+			for name, value := range tt.claims {
+				claims[name] = value
+			}
+
+			login := startOIDCLogin(t, handler, provider, claims)
+
+			if tt.setup != nil {
+				tt.setup(provider)
+			}
+
+			status, response := completeOIDCLogin(t, handler, login)
+			if status != http.StatusUnauthorized {
+				t.Errorf("got status %d; want %d: %v", status, http.StatusUnauthorized, response)
+			}
+
+			_, err := app.models.Users.GetByEmail(context.Background(), "dave@example.com")
+			if !errors.Is(err, data.ErrRecordNotFound) {
+				t.Errorf("got error %v looking up the user; want none created", err)
+			}
+		})
+	}
+}
+
+func TestDeleteCurrentUserConfirmedByOIDCLogin(t *testing.T) {
+	app, provider := newOIDCTestApplication(t)
+	handler := app.routes()
+
+	frank := map[string]any{"sub": "frank", "email": "frank@example.com", "email_verified": true}
+
+	status, response := completeOIDCLogin(t, handler, startOIDCLogin(t, handler, provider, frank))
+	if status != http.StatusCreated {
+		t.Fatalf("got status %d signing in; want %d: %v", status, http.StatusCreated, response)
+	}
+
+	authenticationToken, _ := response["authentication_token"].(map[string]any)
+	token, _ := authenticationToken["token"].(string)
+
+	deleteCurrentUser := func(login oidcLogin) (int, map[string]any) {
+		return requestJSON(t, handler, http.MethodDelete, "/v1/users/me", token, map[string]any{"oidc": login})
+	}
+
+	// Signing in as Grace, who has an account of their own, does not confirm
+	// deleting Frank's.
+	grace := map[string]any{"sub": "grace", "email": "grace@example.com", "email_verified": true}
+
+	status, response = completeOIDCLogin(t, handler, startOIDCLogin(t, handler, provider, grace))
+	if status != http.StatusCreated {
+		t.Fatalf("got status %d signing in; want %d: %v", status, http.StatusCreated, response)
+	}
+
+	status, response = deleteCurrentUser(startOIDCLogin(t, handler, provider, grace))
+	if status != http.StatusUnprocessableEntity {
+		t.Errorf("got status %d confirming as another user's identity; want %d: %v", status, http.StatusUnprocessableEntity, response)
+	}
+
+	login := startOIDCLogin(t, handler, provider, frank)
+	login.LoginSecret = ""
+
+	status, response = deleteCurrentUser(login)
+	if status != http.StatusUnauthorized {
+		t.Errorf("got status %d confirming without the login secret; want %d: %v", status, http.StatusUnauthorized, response)
+	}
+
+	status, response = deleteCurrentUser(startOIDCLogin(t, handler, provider, frank))
+	if status != http.StatusAccepted {
+		t.Fatalf("got status %d; want %d: %v", status, http.StatusAccepted, response)
+	}
+
+	user, err := app.models.Users.GetByEmail(context.Background(), "frank@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.DeletionRequestedAt == nil {
+		t.Errorf("got user %+v; want deletion requested", user)
+	}
+}
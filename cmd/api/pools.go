@@ -0,0 +1,99 @@
+package main
+
+import (
+	"autherain/golang_arxiv/internal/observability"
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.uber.org/zap"
+)
+
+const (
+	poolCheckInterval = 10 * time.Second
+	poolCheckTimeout  = 2 * time.Second
+)
+
+// monitorPools checks every database pool on an interval, so that reads stop
+// going to a replica that is down and resume once it is back, and reports the
+// connection statistics of each pool as gauges through the observability
+// registry, one set of gauges for all pools with a pool attribute.
+func (app *application) monitorPools(interval time.Duration) {
+	if len(app.pools) == 0 {
+		return
+	}
+
+	if app.config.telemetry.enabled {
+		for _, stat := range poolStats {
+			name := poolMetricName(stat)
+
+			_, err := observability.CreateGauge(name, "Database pools: "+stat, "")
+			if err != nil {
+				app.logger.Error("failed to create pool gauge", zap.String("gauge", name), zap.Error(err))
+			}
+		}
+	}
+
+	app.background(app.checkPools)
+	app.every(interval, app.checkPools)
+}
+
+// checkPools checks the health of each pool and reports its gauges.
+func (app *application) checkPools() {
+	ctx := context.Background()
+
+	for _, pool := range app.pools {
+		wasHealthy := pool.Healthy()
+
+		err := pool.Check(ctx, poolCheckTimeout)
+		switch {
+		case err != nil && wasHealthy:
+			app.logger.Warn("database pool unhealthy", zap.String("pool", pool.Name), zap.Error(err))
+		case err == nil && !wasHealthy:
+			app.logger.Info("database pool recovered", zap.String("pool", pool.Name))
+		}
+
+		healthy := 0.0
+		if err == nil {
+			healthy = 1
+		}
+
+		stats := pool.DB.Stats()
+
+		values := map[string]float64{
+			"healthy":               healthy,
+			"max_open_connections":  float64(stats.MaxOpenConnections),
+			"open_connections":      float64(stats.OpenConnections),
+			"in_use":                float64(stats.InUse),
+			"idle":                  float64(stats.Idle),
+			"wait_count":            float64(stats.WaitCount),
+			"wait_duration_seconds": stats.WaitDuration.Seconds(),
+			"max_idle_closed":       float64(stats.MaxIdleClosed),
+			"max_idle_time_closed":  float64(stats.MaxIdleTimeClosed),
+			"max_lifetime_closed":   float64(stats.MaxLifetimeClosed),
+		}
+
+		for _, stat := range poolStats {
+			observability.SetGauge(ctx, poolMetricName(stat), values[stat], attribute.String("pool", pool.Name))
+		}
+	}
+}
+
+// poolStats are the gauges reported for each pool: its health and the fields
+// of sql.DBStats.
+var poolStats = []string{
+	"healthy",
+	"max_open_connections",
+	"open_connections",
+	"in_use",
+	"idle",
+	"wait_count",
+	"wait_duration_seconds",
+	"max_idle_closed",
+	"max_idle_time_closed",
+	"max_lifetime_closed",
+}
+
+func poolMetricName(stat string) string {
+	return "db_pool_" + stat
+}
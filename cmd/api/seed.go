@@ -0,0 +1,438 @@
+package main
+
+import (
+	"autherain/golang_arxiv/internal/data"
+	"autherain/golang_arxiv/internal/validator"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const seedUsage = `usage: api seed [flags]
+
+Adds generated movies and users to the database named by the configuration,
+in a single transaction, and prints the users' credentials and
+authentication tokens. The same -seed generates the same data, relative to
+the current year.
+
+Each -users flag adds a group of users: COUNT[/PERMISSIONS][/inactive], with
+PERMISSIONS a comma-separated list of codes. For example:
+
+	api seed -movies 500 -users 5/movies:read -users 1/movies:read,movies:write -users 2//inactive
+
+flags:`
+
+// userGroup is one -users flag.
+type userGroup struct {
+	count       int
+	permissions []string
+	activated   bool
+}
+
+type userGroups []userGroup
+
+func (g *userGroups) String() string {
+	parts := make([]string, 0, len(*g))
+	for _, group := range *g {
+		part := strconv.Itoa(group.count) + "/" + strings.Join(group.permissions, ",")
+		if !group.activated {
+			part += "/inactive"
+		}
+		parts = append(parts, part)
+	}
+
+	return strings.Join(parts, " ")
+}
+
+func (g *userGroups) Set(value string) error {
+	fields := strings.Split(value, "/")
+	if len(fields) > 3 {
+		return errors.New("must be COUNT[/PERMISSIONS][/inactive]")
+	}
+
+	count, err := strconv.Atoi(fields[0])
+	if err != nil || count < 1 {
+		return fmt.Errorf("invalid user count %q", fields[0])
+	}
+
+	group := userGroup{count: count, activated: true}
+
+	if len(fields) > 1 && fields[1] != "" {
+		group.permissions = strings.Split(fields[1], ",")
+	}
+
+	if len(fields) == 3 {
+		if fields[2] != "inactive" {
+			return fmt.Errorf("invalid user state %q", fields[2])
+		}
+		group.activated = false
+	}
+
+	*g = append(*g, group)
+
+	return nil
+}
+
+// runSeed implements the seed subcommand. Like migrate, it uses the database
+// named by the configuration whatever the storage backend is set to.
+func runSeed(cfg config, args []string) error {
+	flags := flag.NewFlagSet("seed", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), seedUsage)
+		flags.PrintDefaults()
+	}
+
+	var groups userGroups
+
+	movies := flags.Int("movies", 100, "Number of movies to generate")
+	seed := flags.Uint64("seed", 1, "Random seed")
+	password := flags.String("password", "pa55word1234", "Password given to every user")
+	tokenTTL := flags.Duration("token-ttl", 24*time.Hour, "Lifetime of the printed authentication tokens")
+	timeout := flags.Duration("timeout", 5*time.Minute, "Time allowed for each statement, inserting every movie at once included, in place of DB_QUERY_TIMEOUT")
+	flags.Var(&groups, "users", "Users to add as COUNT[/PERMISSIONS][/inactive]; repeatable (default 1/movies:read,movies:write)")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if flags.NArg() > 0 || *movies < 0 || *timeout <= 0 {
+		flags.Usage()
+		return errors.New("invalid arguments")
+	}
+
+	if len(groups) == 0 {
+		groups = userGroups{{count: 1, permissions: []string{"movies:read", "movies:write"}, activated: true}}
+	}
+
+	v := validator.New()
+	if data.ValidatePasswordPlaintext(v, *password); !v.Valid() {
+		return fmt.Errorf("-password %s", v.Errors["password"])
+	}
+
+	db, driver, err := openDB(cfg, cfg.db.dsn)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	queryConfig := data.QueryConfig{Timeout: *timeout}
+
+	var models data.Models
+	if driver == "sqlite" {
+		models = data.NewSQLiteModels(db, queryConfig)
+	} else {
+		models = data.NewModels(db, nil, queryConfig)
+	}
+
+	gen := newGenerator(*seed)
+
+	users, err := gen.users(groups, *password)
+	if err != nil {
+		return err
+	}
+
+	// Movies are generated up front so that a retried transaction inserts
+	// the same ones. Their owners point into writerIDs, which is filled in
+	// once the users have been inserted.
+	writerIDs := make([]int64, 0, len(users))
+	for _, user := range users {
+		if slices.Contains(user.permissions, "movies:write") {
+			writerIDs = append(writerIDs, 0)
+		}
+	}
+
+	generated := gen.movies(*movies, writerIDs)
+
+	for _, movie := range generated {
+		if data.ValidateMovie(v, movie); !v.Valid() {
+			return fmt.Errorf("generated an invalid movie %q: %v", movie.Title, v.Errors)
+		}
+	}
+
+	ctx := context.Background()
+	tokens := make([]*data.Token, len(users))
+
+	err = models.WithTx(ctx, func(tx data.Models) error {
+		writers := 0
+
+		for i, user := range users {
+			err := tx.Users.Insert(ctx, &user.User)
+			if err != nil {
+				if errors.Is(err, data.ErrDuplicateEmail) {
+					return fmt.Errorf("%s already exists; seed %d has been used, pick another -seed", user.Email, *seed)
+				}
+				return err
+			}
+
+			err = addPermissions(ctx, tx, user.ID, user.permissions)
+			if err != nil {
+				return err
+			}
+
+			if slices.Contains(user.permissions, "movies:write") {
+				writerIDs[writers] = user.ID
+				writers++
+			}
+
+			tokens[i], err = tx.Tokens.New(ctx, user.ID, *tokenTTL, data.ScopeAuthentication)
+			if err != nil {
+				return err
+			}
+		}
+
+		return tx.Movies.InsertMany(ctx, generated)
+	})
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tEMAIL\tPASSWORD\tACTIVATED\tPERMISSIONS\tTOKEN")
+
+	for i, user := range users {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%t\t%s\t%s\n",
+			user.ID, user.Email, *password, user.Activated, strings.Join(user.permissions, ","), tokens[i].Plaintext)
+	}
+
+	err = tw.Flush()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("\n%d movies and %d users added, tokens expire at %s\n", *movies, len(users), time.Now().Add(*tokenTTL).Format(time.RFC3339))
+
+	return nil
+}
+
+// addPermissions grants codes to a user, failing on codes that do not exist,
+// which AddForUser would silently skip.
+func addPermissions(ctx context.Context, models data.Models, userID int64, codes []string) error {
+	if len(codes) == 0 {
+		return nil
+	}
+
+	err := models.Permissions.AddForUser(ctx, userID, codes...)
+	if err != nil {
+		return err
+	}
+
+	granted, err := models.Permissions.GetAllForUser(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	for _, code := range codes {
+		if !granted.Include(code) {
+			return fmt.Errorf("unknown permission %q", code)
+		}
+	}
+
+	return nil
+}
+
+// generator produces plausible fake data from a seeded source, so that a seed
+// always yields the same rows.
+type generator struct {
+	rng *rand.Rand
+}
+
+func newGenerator(seed uint64) *generator {
+	return &generator{rng: rand.New(rand.NewPCG(seed, seed))}
+}
+
+type seedUser struct {
+	data.User
+	permissions []string
+}
+
+func (g *generator) users(groups userGroups, password string) ([]*seedUser, error) {
+	var users []*seedUser
+
+	for _, group := range groups {
+		for range group.count {
+			first, last := pick(g.rng, firstNames), pick(g.rng, lastNames)
+
+			user := &seedUser{permissions: group.permissions}
+			user.Name = first + " " + last
+			user.Email = fmt.Sprintf("%s.%s.%d@example.com", strings.ToLower(first), strings.ToLower(last), g.rng.IntN(1_000_000))
+			user.Activated = group.activated
+
+			err := user.Password.Set(password)
+			if err != nil {
+				return nil, err
+			}
+
+			users = append(users, user)
+		}
+	}
+
+	return users, nil
+}
+
+// movies returns n movies, most of them released, with genres drawn from
+// weighted frequencies. A fifth have no owner, like movies created before
+// ownership was tracked; the rest point at an element of owners.
+func (g *generator) movies(n int, owners []int64) []*data.Movie {
+	currentYear := time.Now().Year()
+
+	movies := make([]*data.Movie, 0, n)
+	titles := make([]string, 0, n)
+
+	for range n {
+		movie := &data.Movie{
+			Title:   g.title(titles),
+			Genres:  g.genres(),
+			Runtime: data.Runtime(clamp(int(g.rng.NormFloat64()*18+105), 70, 210)),
+		}
+
+		switch r := g.rng.Float64(); {
+		case r < 0.80:
+			movie.Status = data.StatusReleased
+			movie.Year = int32(max(currentYear-int(g.rng.ExpFloat64()*15), 1920))
+			movie.ReleaseDates = g.releaseDates(int(movie.Year))
+		case r < 0.88:
+			movie.Status = data.StatusInProduction
+			movie.Year = int32(currentYear + g.rng.IntN(4))
+		case r < 0.95:
+			movie.Status = data.StatusAnnounced
+			movie.Year = int32(currentYear + 1 + g.rng.IntN(10))
+		default:
+			movie.Status = data.StatusCancelled
+			movie.Year = int32(currentYear - 5 + g.rng.IntN(9))
+		}
+
+		if len(owners) > 0 && g.rng.Float64() >= 0.2 {
+			movie.CreatedBy = &owners[g.rng.IntN(len(owners))]
+		}
+
+		titles = append(titles, movie.Title)
+		movies = append(movies, movie)
+	}
+
+	return movies
+}
+
+// title makes up a title, or now and then a sequel to one of earlier.
+func (g *generator) title(earlier []string) string {
+	if len(earlier) > 0 && g.rng.IntN(10) == 0 {
+		return pick(g.rng, earlier) + " " + pick(g.rng, []string{"2", "II", "Returns", "Reloaded"})
+	}
+
+	switch g.rng.IntN(4) {
+	case 0:
+		return "The " + pick(g.rng, titleAdjectives) + " " + pick(g.rng, titleNouns)
+	case 1:
+		return pick(g.rng, titleNouns) + " of " + pick(g.rng, titlePlaces)
+	case 2:
+		return pick(g.rng, titleAdjectives) + " " + pick(g.rng, titleNouns)
+	default:
+		return "The " + pick(g.rng, titleNouns)
+	}
+}
+
+// genres returns one to three distinct genres.
+func (g *generator) genres() []string {
+	count := 1
+	switch r := g.rng.Float64(); {
+	case r >= 0.85:
+		count = 3
+	case r >= 0.5:
+		count = 2
+	}
+
+	genres := make([]string, 0, count)
+
+	for len(genres) < count {
+		genre := g.weightedGenre()
+		if !slices.Contains(genres, genre) {
+			genres = append(genres, genre)
+		}
+	}
+
+	return genres
+}
+
+func (g *generator) weightedGenre() string {
+	total := 0
+	for _, genre := range genreWeights {
+		total += genre.weight
+	}
+
+	n := g.rng.IntN(total)
+
+	for _, genre := range genreWeights {
+		if n < genre.weight {
+			return genre.name
+		}
+		n -= genre.weight
+	}
+
+	return genreWeights[0].name
+}
+
+// releaseDates returns up to three countries' release dates within year.
+func (g *generator) releaseDates(year int) data.ReleaseDates {
+	count := g.rng.IntN(4)
+	if count == 0 {
+		return nil
+	}
+
+	dates := make(data.ReleaseDates, count)
+	start := time.Date(year, time.Month(1+g.rng.IntN(12)), 1+g.rng.IntN(28), 0, 0, 0, 0, time.UTC)
+
+	for _, i := range g.rng.Perm(len(releaseCountries))[:count] {
+		// Later countries follow within a couple of months.
+		date := start.AddDate(0, 0, g.rng.IntN(60))
+		if date.Year() != year {
+			date = start
+		}
+
+		dates[releaseCountries[i]] = date.Format("2006-01-02")
+	}
+
+	return dates
+}
+
+func pick[T any](rng *rand.Rand, values []T) T {
+	return values[rng.IntN(len(values))]
+}
+
+func clamp(n, lo, hi int) int {
+	return min(max(n, lo), hi)
+}
+
+var genreWeights = []struct {
+	name   string
+	weight int
+}{
+	{"drama", 25},
+	{"comedy", 18},
+	{"action", 14},
+	{"thriller", 10},
+	{"romance", 8},
+	{"crime", 6},
+	{"horror", 6},
+	{"sci-fi", 6},
+	{"animation", 4},
+	{"documentary", 3},
+}
+
+var (
+	titleAdjectives = []string{"Silent", "Crimson", "Last", "Hidden", "Broken", "Golden", "Endless", "Midnight", "Forgotten", "Electric", "Wild", "Lonely", "Burning", "Frozen", "Secret", "Savage", "Distant", "Hollow", "Shattered", "Quiet"}
+	titleNouns      = []string{"River", "Empire", "Horizon", "Garden", "Machine", "Kingdom", "Stranger", "Harbor", "Signal", "Mountain", "Promise", "Shadow", "Witness", "Frontier", "Letter", "Orchard", "Circus", "Voyage", "Lighthouse", "Storm"}
+	titlePlaces     = []string{"Paris", "the North", "Tomorrow", "the Valley", "Mars", "the Sea", "Brooklyn", "the Desert", "Avalon", "Rome"}
+
+	firstNames = []string{"Alice", "Bob", "Carmen", "Dmitri", "Esther", "Farid", "Grace", "Hiro", "Ines", "Jonas", "Keiko", "Liam", "Maya", "Nikolai", "Olga", "Pedro", "Quinn", "Rosa", "Samir", "Tess"}
+	lastNames  = []string{"Anderson", "Becker", "Costa", "Dubois", "Eriksen", "Fischer", "Garcia", "Haddad", "Ito", "Jansen", "Kowalski", "Lopez", "Moreau", "Nakamura", "Okafor", "Petrov", "Rossi", "Silva", "Tanaka", "Weber"}
+
+	releaseCountries = []string{"US", "GB", "FR", "DE", "JP", "IN", "BR", "CA", "AU", "KR"}
+)
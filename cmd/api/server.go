@@ -39,6 +39,8 @@ func (app *application) serve() error {
 			shutdownError <- err
 		}
 
+		close(app.shutdown)
+
 		app.logger.Info("completing background tasks", zap.String("addr", srv.Addr))
 		app.wg.Wait()
 
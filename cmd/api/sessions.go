@@ -0,0 +1,225 @@
+package main
+
+import (
+	"autherain/golang_arxiv/internal/data"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/tomasen/realip"
+	"go.uber.org/zap"
+)
+
+// maxUserAgentLength bounds the user agent stored with a session.
+const maxUserAgentLength = 512
+
+// session is an authentication token as shown to its owner.
+type session struct {
+	ID         int64      `json:"id"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	Expiry     time.Time  `json:"expiry"`
+	IP         string     `json:"ip"`
+	UserAgent  string     `json:"user_agent"`
+	Current    bool       `json:"current"`
+}
+
+// sessionTouches throttles the writes recording that a token was used, so
+// that a busy client does not cause one write per request. Touch applies the
+// same interval in the database for requests spread over several processes.
+type sessionTouches struct {
+	mu       sync.Mutex
+	interval time.Duration
+	last     map[string]time.Time
+}
+
+func newSessionTouches(interval time.Duration) *sessionTouches {
+	return &sessionTouches{interval: interval, last: make(map[string]time.Time)}
+}
+
+// due reports whether token should be touched now, and if so records that it
+// has been.
+func (s *sessionTouches) due(token string, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if last, ok := s.last[token]; ok && now.Sub(last) < s.interval {
+		return false
+	}
+
+	// Entries are only needed for one interval, so they are swept whenever
+	// the map has grown, rather than on a timer.
+	if len(s.last) >= 10_000 {
+		for t, last := range s.last {
+			if now.Sub(last) >= s.interval {
+				delete(s.last, t)
+			}
+		}
+	}
+
+	s.last[token] = now
+
+	return true
+}
+
+func requestUserAgent(r *http.Request) string {
+	userAgent := r.UserAgent()
+	if len(userAgent) > maxUserAgentLength {
+		userAgent = userAgent[:maxUserAgentLength]
+	}
+
+	return userAgent
+}
+
+// touchSession records the use of an authentication token in the background,
+// unless it was already recorded within the touch interval.
+func (app *application) touchSession(r *http.Request, token string) {
+	now := time.Now()
+
+	if !app.sessionTouches.due(token, now) {
+		return
+	}
+
+	ip := realip.FromRequest(r)
+	userAgent := requestUserAgent(r)
+	notBefore := now.Add(-app.config.sessions.touchInterval)
+
+	app.background(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), app.config.db.queryTimeout)
+		defer cancel()
+
+		err := app.models.Tokens.Touch(ctx, token, ip, userAgent, notBefore)
+		if err != nil {
+			app.logger.Error("failed to record session use", zap.Error(err))
+		}
+	})
+}
+
+func (app *application) listSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+	currentHash := sha256.Sum256([]byte(app.contextGetToken(r)))
+
+	// A signed token is not stored, so its session is found by family.
+	var currentFamily string
+	if claims := app.contextGetClaims(r); claims != nil {
+		currentFamily = claims.Family
+	}
+
+	tokens, err := app.models.Tokens.GetAllForUser(r.Context(), user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"sessions": groupSessions(tokens, currentHash[:], currentFamily)}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// groupSessions folds the tokens of each login into one session, newest
+// first. A session is identified by its unrotated refresh token, which
+// changes on every refresh, or by its authentication token when it has none.
+// The address and user agent are those of the token used most recently.
+func groupSessions(tokens []*data.Token, currentHash []byte, currentFamily string) []session {
+	sessions := []session{}
+	index := make(map[string]int)
+	active := make(map[string]time.Time)
+
+	// tokens are ordered newest first, so the first token of a family
+	// starts its session.
+	for _, token := range tokens {
+		if token.Scope != data.ScopeAuthentication && token.Scope != data.ScopeRefresh {
+			continue
+		}
+
+		key := token.Family
+		if key == "" {
+			key = fmt.Sprintf("token:%d", token.ID)
+		}
+
+		i, ok := index[key]
+		if !ok {
+			i = len(sessions)
+			index[key] = i
+			sessions = append(sessions, session{CreatedAt: token.CreatedAt})
+		}
+
+		s := &sessions[i]
+
+		if token.CreatedAt.Before(s.CreatedAt) {
+			s.CreatedAt = token.CreatedAt
+		}
+
+		switch {
+		case token.Scope == data.ScopeRefresh && token.RotatedAt == nil:
+			s.ID, s.Expiry = token.ID, token.Expiry
+		case token.Scope == data.ScopeAuthentication && s.ID == 0:
+			s.ID, s.Expiry = token.ID, token.Expiry
+		}
+
+		if token.LastUsedAt != nil && (s.LastUsedAt == nil || token.LastUsedAt.After(*s.LastUsedAt)) {
+			s.LastUsedAt = token.LastUsedAt
+		}
+
+		activeAt := token.CreatedAt
+		if token.LastUsedAt != nil {
+			activeAt = *token.LastUsedAt
+		}
+
+		if last, ok := active[key]; !ok || activeAt.After(last) {
+			active[key] = activeAt
+			s.IP, s.UserAgent = token.IP, token.UserAgent
+		}
+
+		if bytes.Equal(token.Hash, currentHash) || (currentFamily != "" && token.Family == currentFamily) {
+			s.Current = true
+		}
+	}
+
+	return sessions
+}
+
+func (app *application) deleteSessionHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	err = app.models.WithTx(r.Context(), func(tx data.Models) error {
+		err := app.denySessions(r.Context(), tx, user.ID, func(token *data.Token) bool { return token.ID == id })
+		if err != nil {
+			return err
+		}
+
+		// The ID is that of a refresh token unless the session has none.
+		err = tx.Tokens.DeleteByID(r.Context(), data.ScopeRefresh, user.ID, id)
+		if errors.Is(err, data.ErrRecordNotFound) {
+			err = tx.Tokens.DeleteByID(r.Context(), data.ScopeAuthentication, user.ID, id)
+		}
+
+		return err
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "session successfully revoked"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
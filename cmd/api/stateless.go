@@ -0,0 +1,150 @@
+package main
+
+import (
+	"autherain/golang_arxiv/internal/data"
+	"autherain/golang_arxiv/internal/signedtoken"
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// authenticateSigned verifies a signed token and returns the request carrying
+// the user and claims it describes. The user holds only the ID and activation
+// state; see requireUserRecord for handlers that need the rest.
+func (app *application) authenticateSigned(r *http.Request, token string) (*http.Request, error) {
+	claims, err := app.signer.Verify(token)
+	if err != nil {
+		return nil, err
+	}
+
+	if app.config.auth.denylist && claims.Family != "" {
+		denied, err := app.models.Denylist.Contains(r.Context(), claims.Family)
+		if err != nil {
+			return nil, err
+		}
+
+		if denied {
+			return nil, signedtoken.ErrInvalidToken
+		}
+	}
+
+	r = app.contextSetUser(r, &data.User{ID: claims.UserID(), Activated: claims.Activated})
+	r = app.contextSetClaims(r, claims)
+
+	return r, nil
+}
+
+// requireUserRecord replaces the partial user built from a signed token with
+// the stored one, for handlers that show or change the account.
+func (app *application) requireUserRecord(next http.HandlerFunc) http.HandlerFunc {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		if app.contextGetClaims(r) == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		user, err := app.models.Users.Get(r.Context(), app.contextGetUser(r).ID)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				app.invalidAuthenticationTokenResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		next.ServeHTTP(w, app.contextSetUser(r, user))
+	}
+
+	return app.requireSession(fn)
+}
+
+// signAccessToken returns a signed authentication token for user in family,
+// carrying their current permissions as read through models.
+func (app *application) signAccessToken(ctx context.Context, models data.Models, user *data.User, family string) (*data.Token, error) {
+	permissions, err := models.Permissions.GetAllForUser(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	claims := signedtoken.Claims{
+		Activated:   user.Activated,
+		Permissions: permissions,
+		Family:      family,
+	}
+
+	plaintext, expiry, err := app.signer.Sign(user.ID, claims, app.config.auth.accessTokenTTL)
+	if err != nil {
+		return nil, err
+	}
+
+	return &data.Token{Plaintext: plaintext, UserID: user.ID, Expiry: expiry, Scope: data.ScopeAuthentication, Family: family}, nil
+}
+
+// denyFamilies denies the signed tokens of the given sessions for as long as
+// any of them can still be valid. It does nothing unless signed tokens and the
+// denylist are both enabled.
+func (app *application) denyFamilies(ctx context.Context, models data.Models, families ...string) error {
+	if app.signer == nil || !app.config.auth.denylist {
+		return nil
+	}
+
+	expiry := time.Now().Add(app.config.auth.accessTokenTTL)
+
+	for _, family := range families {
+		if family == "" {
+			continue
+		}
+
+		err := models.Denylist.Add(ctx, family, expiry)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// denySessions denies the sessions of userID holding a token that matches.
+// Call it before deleting the tokens, while their families can still be read.
+func (app *application) denySessions(ctx context.Context, models data.Models, userID int64, match func(*data.Token) bool) error {
+	if app.signer == nil || !app.config.auth.denylist {
+		return nil
+	}
+
+	tokens, err := models.Tokens.GetAllForUser(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	var families []string
+
+	for _, token := range tokens {
+		if match(token) {
+			families = append(families, token.Family)
+		}
+	}
+
+	return app.denyFamilies(ctx, models, families...)
+}
+
+// pruneDenylist deletes expired denylist entries on an interval.
+func (app *application) pruneDenylist(interval time.Duration) {
+	if app.signer == nil || !app.config.auth.denylist {
+		return
+	}
+
+	app.every(interval, func() {
+		ctx, cancel := context.WithTimeout(context.Background(), purgeTimeout)
+		defer cancel()
+
+		err := app.models.Denylist.DeleteExpired(ctx)
+		if err != nil {
+			app.logger.Error("failed to prune token denylist", zap.Error(err))
+		}
+	})
+}
@@ -3,9 +3,12 @@ package main
 import (
 	"autherain/golang_arxiv/internal/data"
 	"autherain/golang_arxiv/internal/validator"
+	"context"
 	"errors"
 	"net/http"
 	"time"
+
+	"github.com/tomasen/realip"
 )
 
 func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
@@ -30,7 +33,7 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 		return
 	}
 
-	user, err := app.models.Users.GetByEmail(input.Email)
+	user, err := app.models.Users.GetByEmail(r.Context(), input.Email)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -52,13 +55,258 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 		return
 	}
 
-	token, err := app.models.Tokens.New(user.ID, 24*time.Hour, data.ScopeAuthentication)
+	family, err := data.NewTokenFamily()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	var token, refreshToken *data.Token
+
+	err = app.models.WithTx(r.Context(), func(tx data.Models) error {
+		err := app.restoreAccount(r.Context(), tx, user)
+		if err != nil {
+			return err
+		}
+
+		token, refreshToken, err = app.issueSessionTokens(r, tx, user, family)
+		return err
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	env := envelope{"authentication_token": token, "refresh_token": refreshToken}
+
+	err = app.writeJSON(w, http.StatusCreated, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// restoreAccount cancels the pending deletion of user, if any, since logging
+// in during the grace period restores the account. It updates a copy, so
+// that user is unchanged if the transaction is retried.
+func (app *application) restoreAccount(ctx context.Context, models data.Models, user *data.User) error {
+	if user.DeletionRequestedAt == nil {
+		return nil
+	}
+
+	restored := *user
+	restored.DeletionRequestedAt = nil
+
+	err := models.Users.Update(ctx, &restored)
+	if err != nil {
+		return err
+	}
+
+	return models.Audit.Insert(ctx, &data.AuditEntry{UserID: user.ID, Action: data.AuditDeletionCancelled})
+}
+
+// issueSessionTokens stores and returns a short-lived authentication token
+// and the refresh token that replaces it, both in family and tagged with the
+// client making the request. In stateless mode the authentication token is
+// signed instead of stored.
+func (app *application) issueSessionTokens(r *http.Request, models data.Models, user *data.User, family string) (*data.Token, *data.Token, error) {
+	refreshToken, err := data.GenerateToken(user.ID, app.config.auth.refreshTokenTTL, data.ScopeRefresh)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tokens := []*data.Token{refreshToken}
+
+	var token *data.Token
+
+	if app.signer != nil {
+		token, err = app.signAccessToken(r.Context(), models, user, family)
+	} else {
+		token, err = data.GenerateToken(user.ID, app.config.auth.accessTokenTTL, data.ScopeAuthentication)
+		tokens = append(tokens, token)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, t := range tokens {
+		t.Family = family
+		t.IP = realip.FromRequest(r)
+		t.UserAgent = requestUserAgent(r)
+
+		err := models.Tokens.Insert(r.Context(), t)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return token, refreshToken, nil
+}
+
+// refreshAuthenticationTokenHandler exchanges a refresh token for a new
+// authentication token and a new refresh token. The refresh token used is
+// kept, marked as rotated, so that presenting it again can be recognised: it
+// means the token was copied, and the whole family is revoked.
+func (app *application) refreshAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlaintext string `json:"token"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateTokenPlaintext(v, input.TokenPlaintext); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	var (
+		token, refreshToken *data.Token
+		retried, reused     bool
+	)
+
+	err = app.models.WithTx(r.Context(), func(tx data.Models) error {
+		presented, err := tx.Tokens.GetByPlaintext(r.Context(), data.ScopeRefresh, input.TokenPlaintext)
+		if err != nil {
+			return err
+		}
+
+		if presented.RotatedAt != nil && time.Since(*presented.RotatedAt) < app.config.auth.refreshGracePeriod {
+			retried = true
+			return nil
+		}
+
+		reused = presented.RotatedAt != nil
+
+		if reused {
+			err := tx.Tokens.DeleteFamily(r.Context(), presented.UserID, presented.Family)
+			if err != nil {
+				return err
+			}
+
+			err = app.denyFamilies(r.Context(), tx, presented.Family)
+			if err != nil {
+				return err
+			}
+
+			return tx.Audit.Insert(r.Context(), &data.AuditEntry{UserID: presented.UserID, Action: data.AuditRefreshReused})
+		}
+
+		err = tx.Tokens.MarkRotated(r.Context(), presented.ID)
+		if err != nil {
+			return err
+		}
+
+		user, err := tx.Users.Get(r.Context(), presented.UserID)
+		if err != nil {
+			return err
+		}
+
+		// Authentication tokens issued earlier in the family are left to
+		// expire, since they are short-lived.
+		token, refreshToken, err = app.issueSessionTokens(r, tx, user, presented.Family)
+		return err
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound), errors.Is(err, data.ErrEditConflict):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	switch {
+	case retried:
+		app.refreshTokenRotatedResponse(w, r)
+		return
+	case reused:
+		app.invalidAuthenticationTokenResponse(w, r)
+		return
+	}
+
+	env := envelope{"authentication_token": token, "refresh_token": refreshToken}
+
+	err = app.writeJSON(w, http.StatusCreated, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// revokeSessions deletes every authentication and refresh token of the user,
+// and denies the signed tokens of their sessions.
+func (app *application) revokeSessions(ctx context.Context, models data.Models, userID int64) error {
+	err := app.denySessions(ctx, models, userID, func(*data.Token) bool { return true })
+	if err != nil {
+		return err
+	}
+
+	for _, scope := range []string{data.ScopeAuthentication, data.ScopeRefresh} {
+		err = models.Tokens.DeleteAllForUser(ctx, scope, userID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (app *application) deleteAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	var err error
+
+	// A signed token cannot be deleted, so its session is revoked instead.
+	if claims := app.contextGetClaims(r); claims != nil {
+		err = app.models.WithTx(r.Context(), func(tx data.Models) error {
+			err := tx.Tokens.DeleteFamily(r.Context(), user.ID, claims.Family)
+			if err != nil {
+				return err
+			}
+
+			return app.denyFamilies(r.Context(), tx, claims.Family)
+		})
+	} else {
+		err = app.models.Tokens.Delete(r.Context(), data.ScopeAuthentication, user.ID, app.contextGetToken(r))
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "you have been logged out"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteAllAuthenticationTokensHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	err := app.models.WithTx(r.Context(), func(tx data.Models) error {
+		return app.revokeSessions(r.Context(), tx, user.ID)
+	})
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusCreated, envelope{"authentication_token": token}, nil)
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "all of your sessions have been logged out"}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -82,7 +330,7 @@ func (app *application) createPasswordResetTokenHandler(w http.ResponseWriter, r
 		return
 	}
 
-	user, err := app.models.Users.GetByEmail(input.Email)
+	user, err := app.models.Users.GetByEmail(r.Context(), input.Email)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -100,7 +348,7 @@ func (app *application) createPasswordResetTokenHandler(w http.ResponseWriter, r
 		return
 	}
 
-	token, err := app.models.Tokens.New(user.ID, 45*time.Minute, data.ScopePasswordReset)
+	token, err := app.models.Tokens.New(r.Context(), user.ID, 45*time.Minute, data.ScopePasswordReset)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
@@ -143,7 +391,7 @@ func (app *application) createActivationTokenHandler(w http.ResponseWriter, r *h
 		return
 	}
 
-	user, err := app.models.Users.GetByEmail(input.Email)
+	user, err := app.models.Users.GetByEmail(r.Context(), input.Email)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -161,7 +409,7 @@ func (app *application) createActivationTokenHandler(w http.ResponseWriter, r *h
 		return
 	}
 
-	token, err := app.models.Tokens.New(user.ID, 3*24*time.Hour, data.ScopeActivation)
+	token, err := app.models.Tokens.New(r.Context(), user.ID, 3*24*time.Hour, data.ScopeActivation)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
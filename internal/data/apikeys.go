@@ -0,0 +1,217 @@
+package data
+
+import (
+	"autherain/golang_arxiv/internal/validator"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"time"
+)
+
+// APIKey is a long-lived credential for a machine client. It acts for its
+// owner, but only with Permissions, which are a subset of the owner's when
+// the key is created. Plaintext is set only when the key is generated.
+type APIKey struct {
+	ID          int64       `json:"id"`
+	Plaintext   string      `json:"key,omitempty"`
+	Hash        []byte      `json:"-"`
+	UserID      int64       `json:"-"`
+	Name        string      `json:"name"`
+	Permissions Permissions `json:"permissions"`
+	CreatedAt   time.Time   `json:"created_at"`
+	Expiry      *time.Time  `json:"expiry"`
+}
+
+// GenerateAPIKey returns a new key without storing it. A nil expiry means
+// the key does not expire.
+func GenerateAPIKey(userID int64, name string, permissions Permissions, expiry *time.Time) (*APIKey, error) {
+	key := &APIKey{
+		UserID:      userID,
+		Name:        name,
+		Permissions: permissions,
+		Expiry:      expiry,
+	}
+
+	randomBytes := make([]byte, 32)
+
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	key.Plaintext = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)
+
+	hash := sha256.Sum256([]byte(key.Plaintext))
+	key.Hash = hash[:]
+
+	return key, nil
+}
+
+func ValidateAPIKeyPlaintext(v *validator.Validator, keyPlaintext string) {
+	v.Check(keyPlaintext != "", "key", "must be provided")
+	v.Check(len(keyPlaintext) == 52, "key", "must be 52 bytes long")
+}
+
+// ValidateAPIKey checks the name, expiry and permissions of a key its owner,
+// holding granted, asks for.
+func ValidateAPIKey(v *validator.Validator, key *APIKey, granted Permissions) {
+	v.Check(key.Name != "", "name", "must be provided")
+	v.Check(len(key.Name) <= 100, "name", "must not be more than 100 bytes long")
+
+	if key.Expiry != nil {
+		v.Check(key.Expiry.After(time.Now()), "expiry", "must be in the future")
+	}
+
+	v.Check(key.Permissions != nil, "permissions", "must be provided")
+	v.Check(len(key.Permissions) >= 1, "permissions", "must contain at least 1 permission")
+	v.Check(validator.Unique(key.Permissions), "permissions", "must not contain duplicate values")
+
+	for _, code := range key.Permissions {
+		v.Check(granted.Include(code), "permissions", "must only contain permissions you hold")
+	}
+}
+
+type APIKeyModel struct {
+	DB      DBTX
+	Timeout time.Duration
+}
+
+func (m APIKeyModel) Insert(ctx context.Context, key *APIKey) error {
+	query := `
+        INSERT INTO api_keys (hash, user_id, name, permissions, expiry)
+        VALUES ($1, $2, $3, $4, $5)
+        RETURNING id, created_at`
+
+	args := []any{key.Hash, key.UserID, key.Name, []string(key.Permissions), key.Expiry}
+
+	ctx, cancel := withOperation(ctx, "APIKeyModel.Insert", m.Timeout)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&key.ID, &key.CreatedAt)
+}
+
+// GetByPlaintext returns the key with the given plaintext, unless it has
+// expired.
+func (m APIKeyModel) GetByPlaintext(ctx context.Context, keyPlaintext string) (*APIKey, error) {
+	keyHash := sha256.Sum256([]byte(keyPlaintext))
+
+	query := `
+        SELECT id, hash, user_id, name, permissions, created_at, expiry
+        FROM api_keys
+        WHERE hash = $1 AND (expiry IS NULL OR expiry > NOW())`
+
+	ctx, cancel := withOperation(ctx, "APIKeyModel.GetByPlaintext", m.Timeout)
+	defer cancel()
+
+	key, err := scanAPIKey(m.DB.QueryRowContext(ctx, query, keyHash[:]), pgArray)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return key, nil
+}
+
+// GetAllForUser returns the user's keys, expired ones included, most
+// recently created first.
+func (m APIKeyModel) GetAllForUser(ctx context.Context, userID int64) ([]*APIKey, error) {
+	query := `
+        SELECT id, hash, user_id, name, permissions, created_at, expiry
+        FROM api_keys
+        WHERE user_id = $1
+        ORDER BY created_at DESC, id DESC`
+
+	ctx, cancel := withOperation(ctx, "APIKeyModel.GetAllForUser", m.Timeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanAPIKeys(rows, pgArray)
+}
+
+func (m APIKeyModel) Delete(ctx context.Context, userID, id int64) error {
+	query := `
+        DELETE FROM api_keys
+        WHERE id = $1 AND user_id = $2`
+
+	ctx, cancel := withOperation(ctx, "APIKeyModel.Delete", m.Timeout)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id, userID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+func (m APIKeyModel) DeleteAllForUser(ctx context.Context, userID int64) error {
+	query := `
+        DELETE FROM api_keys
+        WHERE user_id = $1`
+
+	ctx, cancel := withOperation(ctx, "APIKeyModel.DeleteAllForUser", m.Timeout)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID)
+	return err
+}
+
+// scanAPIKey reads the columns selected by GetByPlaintext and GetAllForUser,
+// decoding permissions with array, which differs between databases.
+func scanAPIKey(row interface{ Scan(dest ...any) error }, array func(dest any) sql.Scanner) (*APIKey, error) {
+	var key APIKey
+
+	err := row.Scan(
+		&key.ID,
+		&key.Hash,
+		&key.UserID,
+		&key.Name,
+		array((*[]string)(&key.Permissions)),
+		&key.CreatedAt,
+		&key.Expiry,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &key, nil
+}
+
+func scanAPIKeys(rows *Rows, array func(dest any) sql.Scanner) ([]*APIKey, error) {
+	keys := []*APIKey{}
+
+	for rows.Next() {
+		key, err := scanAPIKey(rows, array)
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, key)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
@@ -0,0 +1,82 @@
+package data
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	AuditDeletionRequested = "account.deletion_requested"
+	AuditDeletionCancelled = "account.deletion_cancelled"
+	AuditDataExported      = "account.data_exported"
+	AuditPurged            = "account.purged"
+	AuditIdentityLinked    = "account.identity_linked"
+	AuditRefreshReused     = "session.refresh_token_reused"
+	AuditAPIKeyCreated     = "api_key.created"
+	AuditAPIKeyRevoked     = "api_key.revoked"
+)
+
+// AuditEntry records an action taken on an account. Entries are kept after
+// the account is purged, so UserID may no longer refer to a user.
+type AuditEntry struct {
+	ID        int64     `json:"id"`
+	UserID    int64     `json:"-"`
+	Action    string    `json:"action"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type AuditModel struct {
+	DB      DBTX
+	Timeout time.Duration
+}
+
+func (m AuditModel) Insert(ctx context.Context, entry *AuditEntry) error {
+	query := `
+        INSERT INTO audit_log (user_id, action)
+        VALUES ($1, $2)
+        RETURNING id, created_at`
+
+	ctx, cancel := withOperation(ctx, "AuditModel.Insert", m.Timeout)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, entry.UserID, entry.Action).Scan(&entry.ID, &entry.CreatedAt)
+}
+
+func (m AuditModel) GetAllForUser(ctx context.Context, userID int64) ([]*AuditEntry, error) {
+	query := `
+        SELECT id, user_id, action, created_at
+        FROM audit_log
+        WHERE user_id = $1
+        ORDER BY id`
+
+	ctx, cancel := withOperation(ctx, "AuditModel.GetAllForUser", m.Timeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanAuditEntries(rows)
+}
+
+func scanAuditEntries(rows *Rows) ([]*AuditEntry, error) {
+	entries := []*AuditEntry{}
+
+	for rows.Next() {
+		var entry AuditEntry
+
+		err := rows.Scan(&entry.ID, &entry.UserID, &entry.Action, &entry.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, &entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
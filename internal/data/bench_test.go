@@ -0,0 +1,116 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+)
+
+// The benchmarks measure the two queries the API runs most against a
+// migrated Postgres database named by DATA_BENCH_DSN, and are skipped when it
+// is unset. Each runs once per pgx query mode, to compare statements that are
+// prepared once and cached per connection, the pgx default, with unnamed
+// statements parsed by the server on every call, which is how lib/pq sent
+// them:
+//
+//	DATA_BENCH_DSN=postgres://... go test ./internal/data -run '^$' -bench .
+var benchQueryModes = []string{"cache_statement", "exec"}
+
+func BenchmarkMovieModelGetAll(b *testing.B) {
+	filters := Filters{Page: 1, PageSize: 20, Sort: "id", SortSafelist: []string{"id"}}
+
+	for _, mode := range benchQueryModes {
+		b.Run(mode, func(b *testing.B) {
+			models, _ := openBenchModels(b, mode)
+
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					_, _, err := models.Movies.GetAll(context.Background(), "", []string{}, filters)
+					if err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkUserModelGetForToken(b *testing.B) {
+	for _, mode := range benchQueryModes {
+		b.Run(mode, func(b *testing.B) {
+			models, token := openBenchModels(b, mode)
+
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					_, err := models.Users.GetForToken(context.Background(), ScopeAuthentication, token.Plaintext)
+					if err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+// openBenchModels connects to DATA_BENCH_DSN with the pgx query mode and
+// returns the models with an authentication token for a user created for the
+// benchmark, both removed when it ends.
+func openBenchModels(b *testing.B, mode string) (Models, *Token) {
+	b.Helper()
+
+	dsn := os.Getenv("DATA_BENCH_DSN")
+	if dsn == "" {
+		b.Skip("DATA_BENCH_DSN is not set")
+	}
+
+	u, err := url.Parse(dsn)
+	if err != nil || (u.Scheme != "postgres" && u.Scheme != "postgresql") {
+		b.Fatal("DATA_BENCH_DSN must be a postgres:// URL")
+	}
+
+	query := u.Query()
+	query.Set("default_query_exec_mode", mode)
+	u.RawQuery = query.Encode()
+
+	db, err := sql.Open("pgx", u.String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { db.Close() })
+
+	ctx := context.Background()
+
+	models := NewModels(db, nil, QueryConfig{})
+
+	user := &User{
+		Name:      "bench",
+		Email:     fmt.Sprintf("bench-%d@example.com", time.Now().UnixNano()),
+		Activated: true,
+	}
+
+	err = user.Password.Set("bench-password")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	err = models.Users.Insert(ctx, user)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { db.ExecContext(ctx, "DELETE FROM users WHERE id = $1", user.ID) })
+
+	token, err := models.Tokens.New(ctx, user.ID, time.Hour, ScopeAuthentication)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+
+	return models, token
+}
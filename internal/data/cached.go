@@ -0,0 +1,305 @@
+package data
+
+import (
+	"autherain/golang_arxiv/internal/cache"
+	"autherain/golang_arxiv/internal/observability"
+	"autherain/golang_arxiv/internal/pubsub"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Caches are the caches WithCache puts in front of the models. Users holds
+// the result of GetForToken, keyed by token scope and hash.
+type Caches struct {
+	Movies      cache.Cache[int64, *Movie]
+	Permissions cache.Cache[int64, Permissions]
+	Users       cache.Cache[string, *User]
+}
+
+func NewLRUCaches(size int, ttl time.Duration) Caches {
+	return Caches{
+		Movies:      cache.NewLRU[int64, *Movie](size, ttl),
+		Permissions: cache.NewLRU[int64, Permissions](size, ttl),
+		Users:       cache.NewLRU[string, *User](size, ttl),
+	}
+}
+
+// WithCache returns models that serve Movies.Get, Permissions.GetAllForUser
+// and Users.GetForToken from caches. Entries are dropped when the record they
+// hold is written through these models; writes made in a transaction drop
+// them once it has finished. Writes from other processes are only seen once
+// an entry expires, unless Invalidate is subscribed to their events, and token
+// expiry always waits for it, so the cache TTL bounds how stale a read can be.
+func (m Models) WithCache(caches Caches) Models {
+	return m.decorate(caches.wrap)
+}
+
+// Invalidate drops the entries an event from another process makes stale. It
+// is meant to be subscribed to the event bus.
+func (c Caches) Invalidate(event pubsub.Event) {
+	switch event.Kind {
+	case pubsub.MovieChanged:
+		c.Movies.Delete(event.ID)
+	case pubsub.PermissionsChanged:
+		c.Permissions.Delete(event.ID)
+	case pubsub.UserChanged:
+		c.deleteUser(event.ID, "")
+	case pubsub.TokensRevoked:
+		c.deleteUser(event.ID, event.Scope)
+	case pubsub.UserDeleted:
+		c.purgeUser(event.ID)
+	case pubsub.Resync:
+		c.Movies.DeleteFunc(func(int64, *Movie) bool { return true })
+		c.Permissions.DeleteFunc(func(int64, Permissions) bool { return true })
+		c.Users.DeleteFunc(func(string, *User) bool { return true })
+	}
+}
+
+// deleteUser drops the token lookups for userID, only those for scope unless
+// it is empty.
+func (c Caches) deleteUser(userID int64, scope string) {
+	c.Users.DeleteFunc(func(key string, cached *User) bool {
+		return cached.ID == userID && (scope == "" || strings.HasPrefix(key, scope+":"))
+	})
+}
+
+// purgeUser drops everything held about a deleted user, including the
+// movies they created, which no longer name them.
+func (c Caches) purgeUser(userID int64) {
+	c.deleteUser(userID, "")
+	c.Permissions.Delete(userID)
+	c.Movies.DeleteFunc(func(_ int64, cached *Movie) bool {
+		return cached.CreatedBy != nil && *cached.CreatedBy == userID
+	})
+}
+
+func (c Caches) wrap(m Models, pending *[]func()) Models {
+	layer := cacheLayer{caches: c, pending: pending}
+
+	m.Movies = cachedMovieModel{MovieStore: m.Movies, cacheLayer: layer}
+	m.Permissions = cachedPermissionModel{PermissionStore: m.Permissions, cacheLayer: layer}
+	m.Tokens = cachedTokenModel{TokenStore: m.Tokens, cacheLayer: layer}
+	m.Users = cachedUserModel{UserStore: m.Users, cacheLayer: layer}
+
+	return m
+}
+
+// cacheLayer is shared by the cached models. Inside a transaction pending is
+// set: reads bypass the cache, since they must see the transaction's own
+// writes, and invalidations wait until it ends.
+type cacheLayer struct {
+	caches  Caches
+	pending *[]func()
+}
+
+// lookup reports whether a read may be answered from the cache. Reads that
+// must go to the primary skip it, but still refresh the entry.
+func (l cacheLayer) lookup(ctx context.Context) bool {
+	return !usePrimary(ctx)
+}
+
+// fill returns the context for the read that refills an entry. It goes to the
+// primary, since a lagging replica could hand back the value a write has just
+// invalidated, and the entry is then only set if the cache's generation is
+// still the one read before it, so that an invalidation racing the read wins.
+func (l cacheLayer) fill(ctx context.Context) context.Context {
+	return WithPrimary(ctx)
+}
+
+func (l cacheLayer) inTx() bool {
+	return l.pending != nil
+}
+
+func (l cacheLayer) invalidate(fn func()) {
+	if l.pending != nil {
+		*l.pending = append(*l.pending, fn)
+		return
+	}
+
+	fn()
+}
+
+func recordCacheLookup(ctx context.Context, name string, hit bool) {
+	metric := "cache_misses_total"
+	if hit {
+		metric = "cache_hits_total"
+	}
+
+	observability.IncrementCounter(ctx, metric, 1, attribute.String("cache", name))
+}
+
+type cachedMovieModel struct {
+	MovieStore
+	cacheLayer
+}
+
+func (m cachedMovieModel) Get(ctx context.Context, id int64) (*Movie, error) {
+	if m.inTx() {
+		return m.MovieStore.Get(ctx, id)
+	}
+
+	if m.lookup(ctx) {
+		if movie, ok := m.caches.Movies.Get(id); ok {
+			recordCacheLookup(ctx, "movies", true)
+			return cloneMovie(movie), nil
+		}
+
+		recordCacheLookup(ctx, "movies", false)
+	}
+
+	generation := m.caches.Movies.Generation()
+
+	movie, err := m.MovieStore.Get(m.fill(ctx), id)
+	if err != nil {
+		return nil, err
+	}
+
+	m.caches.Movies.Fill(id, cloneMovie(movie), generation)
+
+	return movie, nil
+}
+
+func (m cachedMovieModel) Update(ctx context.Context, movie *Movie) error {
+	id := movie.ID
+	defer m.invalidate(func() { m.caches.Movies.Delete(id) })
+
+	return m.MovieStore.Update(ctx, movie)
+}
+
+func (m cachedMovieModel) Delete(ctx context.Context, id int64) error {
+	defer m.invalidate(func() { m.caches.Movies.Delete(id) })
+
+	return m.MovieStore.Delete(ctx, id)
+}
+
+type cachedPermissionModel struct {
+	PermissionStore
+	cacheLayer
+}
+
+func (m cachedPermissionModel) GetAllForUser(ctx context.Context, userID int64) (Permissions, error) {
+	if m.inTx() {
+		return m.PermissionStore.GetAllForUser(ctx, userID)
+	}
+
+	if m.lookup(ctx) {
+		if permissions, ok := m.caches.Permissions.Get(userID); ok {
+			recordCacheLookup(ctx, "permissions", true)
+			return append(Permissions(nil), permissions...), nil
+		}
+
+		recordCacheLookup(ctx, "permissions", false)
+	}
+
+	generation := m.caches.Permissions.Generation()
+
+	permissions, err := m.PermissionStore.GetAllForUser(m.fill(ctx), userID)
+	if err != nil {
+		return nil, err
+	}
+
+	m.caches.Permissions.Fill(userID, append(Permissions(nil), permissions...), generation)
+
+	return permissions, nil
+}
+
+func (m cachedPermissionModel) AddForUser(ctx context.Context, userID int64, codes ...string) error {
+	defer m.invalidate(func() { m.caches.Permissions.Delete(userID) })
+
+	return m.PermissionStore.AddForUser(ctx, userID, codes...)
+}
+
+type cachedUserModel struct {
+	UserStore
+	cacheLayer
+}
+
+func tokenCacheKey(scope, tokenPlaintext string) string {
+	hash := sha256.Sum256([]byte(tokenPlaintext))
+	return scope + ":" + hex.EncodeToString(hash[:])
+}
+
+func (m cachedUserModel) GetForToken(ctx context.Context, tokenScope, tokenPlaintext string) (*User, error) {
+	if m.inTx() {
+		return m.UserStore.GetForToken(ctx, tokenScope, tokenPlaintext)
+	}
+
+	key := tokenCacheKey(tokenScope, tokenPlaintext)
+
+	if m.lookup(ctx) {
+		if user, ok := m.caches.Users.Get(key); ok {
+			recordCacheLookup(ctx, "users", true)
+			clone := *user
+			return &clone, nil
+		}
+
+		recordCacheLookup(ctx, "users", false)
+	}
+
+	generation := m.caches.Users.Generation()
+
+	user, err := m.UserStore.GetForToken(m.fill(ctx), tokenScope, tokenPlaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	clone := *user
+	m.caches.Users.Fill(key, &clone, generation)
+
+	return user, nil
+}
+
+func (m cachedUserModel) Update(ctx context.Context, user *User) error {
+	userID := user.ID
+	defer m.invalidate(func() { m.caches.deleteUser(userID, "") })
+
+	return m.UserStore.Update(ctx, user)
+}
+
+func (m cachedUserModel) PurgeDeleted(ctx context.Context, before time.Time) ([]int64, error) {
+	ids, err := m.UserStore.PurgeDeleted(ctx, before)
+
+	m.invalidate(func() {
+		for _, id := range ids {
+			m.caches.purgeUser(id)
+		}
+	})
+
+	return ids, err
+}
+
+type cachedTokenModel struct {
+	TokenStore
+	cacheLayer
+}
+
+// Delete, DeleteByID and DeleteFamily may revoke other tokens of the same
+// family, so every authentication lookup for the user is dropped.
+func (m cachedTokenModel) Delete(ctx context.Context, scope string, userID int64, tokenPlaintext string) error {
+	defer m.invalidate(func() { m.caches.deleteUser(userID, ScopeAuthentication) })
+
+	return m.TokenStore.Delete(ctx, scope, userID, tokenPlaintext)
+}
+
+func (m cachedTokenModel) DeleteByID(ctx context.Context, scope string, userID, id int64) error {
+	defer m.invalidate(func() { m.caches.deleteUser(userID, ScopeAuthentication) })
+
+	return m.TokenStore.DeleteByID(ctx, scope, userID, id)
+}
+
+func (m cachedTokenModel) DeleteFamily(ctx context.Context, userID int64, family string) error {
+	defer m.invalidate(func() { m.caches.deleteUser(userID, ScopeAuthentication) })
+
+	return m.TokenStore.DeleteFamily(ctx, userID, family)
+}
+
+func (m cachedTokenModel) DeleteAllForUser(ctx context.Context, scope string, userID int64) error {
+	defer m.invalidate(func() { m.caches.deleteUser(userID, scope) })
+
+	return m.TokenStore.DeleteAllForUser(ctx, scope, userID)
+}
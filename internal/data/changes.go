@@ -0,0 +1,217 @@
+package data
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ChangeCreated = "created"
+	ChangeUpdated = "updated"
+	ChangeDeleted = "deleted"
+)
+
+var ErrInvalidChangeToken = errors.New("invalid change token")
+
+// ChangeToken is the position of a client in the movie change log. Entries
+// are ordered by the id of the transaction that wrote them and then by their
+// own id, and only transactions older than every one still in flight are ever
+// returned, so a token never skips over a change that commits later.
+type ChangeToken struct {
+	TxID uint64
+	ID   int64
+}
+
+func (t ChangeToken) String() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d:%d", t.TxID, t.ID)))
+}
+
+func ParseChangeToken(s string) (ChangeToken, error) {
+	if s == "" {
+		return ChangeToken{}, nil
+	}
+
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return ChangeToken{}, ErrInvalidChangeToken
+	}
+
+	txid, id, found := strings.Cut(string(raw), ":")
+	if !found {
+		return ChangeToken{}, ErrInvalidChangeToken
+	}
+
+	var token ChangeToken
+
+	token.TxID, err = strconv.ParseUint(txid, 10, 64)
+	if err != nil {
+		return ChangeToken{}, ErrInvalidChangeToken
+	}
+
+	token.ID, err = strconv.ParseInt(id, 10, 64)
+	if err != nil || token.ID < 0 {
+		return ChangeToken{}, ErrInvalidChangeToken
+	}
+
+	return token, nil
+}
+
+// MovieChange is the latest change to a movie within a page of the change
+// log. Movie holds the current payload and is nil once the movie is deleted.
+type MovieChange struct {
+	MovieID   int64     `json:"movie_id"`
+	Operation string    `json:"operation"`
+	ChangedAt time.Time `json:"changed_at"`
+	Movie     *Movie    `json:"movie"`
+}
+
+type MovieChangeModel struct {
+	DB      DBTX
+	Timeout time.Duration
+}
+
+// Since returns the changes recorded after token, at most limit log entries
+// at a time, along with the token to resume from. When several entries in the
+// page refer to the same movie only the last one is returned.
+func (m MovieChangeModel) Since(ctx context.Context, token ChangeToken, limit int) ([]*MovieChange, ChangeToken, bool, error) {
+	query := `
+        SELECT id, txid::text, movie_id, operation, changed_at
+        FROM movie_changes
+        WHERE (txid, id) > ($1::text::xid8, $2)
+        AND txid < pg_snapshot_xmin(pg_current_snapshot())
+        ORDER BY txid, id
+        LIMIT $3`
+
+	ctx, cancel := withOperation(ctx, "MovieChangeModel.Since", m.Timeout)
+	defer cancel()
+
+	args := []any{strconv.FormatUint(token.TxID, 10), token.ID, limit + 1}
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, token, false, err
+	}
+
+	defer rows.Close()
+
+	var (
+		next    = token
+		hasMore = false
+		changes = []*MovieChange{}
+		latest  = make(map[int64]int)
+	)
+
+	for rows.Next() {
+		if len(changes) == limit {
+			hasMore = true
+			break
+		}
+
+		var (
+			change MovieChange
+			txid   string
+			id     int64
+		)
+
+		err := rows.Scan(&id, &txid, &change.MovieID, &change.Operation, &change.ChangedAt)
+		if err != nil {
+			return nil, token, false, err
+		}
+
+		next.ID = id
+		next.TxID, err = strconv.ParseUint(txid, 10, 64)
+		if err != nil {
+			return nil, token, false, err
+		}
+
+		if i, ok := latest[change.MovieID]; ok {
+			changes[i] = nil
+		}
+
+		latest[change.MovieID] = len(changes)
+		changes = append(changes, &change)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, token, false, err
+	}
+
+	rows.Close()
+
+	compacted := changes[:0]
+	for _, change := range changes {
+		if change != nil {
+			compacted = append(compacted, change)
+		}
+	}
+
+	err = m.attachMovies(ctx, compacted)
+	if err != nil {
+		return nil, token, false, err
+	}
+
+	return compacted, next, hasMore, nil
+}
+
+func (m MovieChangeModel) attachMovies(ctx context.Context, changes []*MovieChange) error {
+	if len(changes) == 0 {
+		return nil
+	}
+
+	ids := make([]int64, 0, len(changes))
+	for _, change := range changes {
+		ids = append(ids, change.MovieID)
+	}
+
+	query := `
+        SELECT id, created_at, updated_at, title, year, runtime, genres, status, release_dates, created_by, version
+        FROM movies
+        WHERE id = ANY($1)`
+
+	rows, err := m.DB.QueryContext(ctx, query, ids)
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+
+	movies := make(map[int64]*Movie, len(ids))
+
+	for rows.Next() {
+		var movie Movie
+
+		err := rows.Scan(
+			&movie.ID,
+			&movie.CreatedAt,
+			&movie.UpdatedAt,
+			&movie.Title,
+			&movie.Year,
+			&movie.Runtime,
+			pgArray(&movie.Genres),
+			&movie.Status,
+			&movie.ReleaseDates,
+			&movie.CreatedBy,
+			&movie.Version,
+		)
+		if err != nil {
+			return err
+		}
+
+		movies[movie.ID] = &movie
+	}
+
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for _, change := range changes {
+		change.Movie = movies[change.MovieID]
+	}
+
+	return nil
+}
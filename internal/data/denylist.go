@@ -0,0 +1,53 @@
+package data
+
+import (
+	"context"
+	"time"
+)
+
+// DenylistModel holds revoked keys, such as the session a signed token
+// belongs to, until expiry, after which every token they could deny has
+// expired on its own.
+type DenylistModel struct {
+	DB      DBTX
+	Timeout time.Duration
+}
+
+// Add denies key until expiry, or keeps it denied longer if it already is.
+func (m DenylistModel) Add(ctx context.Context, key string, expiry time.Time) error {
+	query := `
+        INSERT INTO token_denylist (key, expiry)
+        VALUES ($1, $2)
+        ON CONFLICT (key) DO UPDATE SET expiry = GREATEST(token_denylist.expiry, EXCLUDED.expiry)`
+
+	ctx, cancel := withOperation(ctx, "DenylistModel.Add", m.Timeout)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, key, expiry)
+	return err
+}
+
+func (m DenylistModel) Contains(ctx context.Context, key string) (bool, error) {
+	query := `
+        SELECT EXISTS (SELECT 1 FROM token_denylist WHERE key = $1 AND expiry > NOW())`
+
+	ctx, cancel := withOperation(ctx, "DenylistModel.Contains", m.Timeout)
+	defer cancel()
+
+	var denied bool
+
+	err := m.DB.QueryRowContext(ctx, query, key).Scan(&denied)
+	return denied, err
+}
+
+func (m DenylistModel) DeleteExpired(ctx context.Context) error {
+	query := `
+        DELETE FROM token_denylist
+        WHERE expiry <= NOW()`
+
+	ctx, cancel := withOperation(ctx, "DenylistModel.DeleteExpired", m.Timeout)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query)
+	return err
+}
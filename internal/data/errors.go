@@ -0,0 +1,171 @@
+package data
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// The kinds of constraint violation reported by ConstraintError, for use with
+// errors.Is.
+var (
+	ErrUniqueViolation     = errors.New("unique constraint violation")
+	ErrCheckViolation      = errors.New("check constraint violation")
+	ErrForeignKeyViolation = errors.New("foreign key violation")
+	ErrNotNullViolation    = errors.New("not null violation")
+)
+
+// ErrSerializationFailure is returned when the database aborted a statement
+// because of a concurrent transaction. Transactions run with WithTx are
+// retried before it reaches the caller.
+var ErrSerializationFailure = errors.New("serialization failure")
+
+// ConstraintError is a statement rejected by a database constraint. Field and
+// Message describe the problem in the terms of the API request, ready to be
+// reported in a validator error map. Field is empty when the database did not
+// say which constraint failed, as SQLite does for foreign keys.
+type ConstraintError struct {
+	Kind       error
+	Constraint string
+	Table      string
+	Column     string
+	Field      string
+	Message    string
+	Err        error
+}
+
+func (e *ConstraintError) Error() string {
+	if e.Constraint == "" {
+		return e.Kind.Error()
+	}
+
+	return fmt.Sprintf("%s: %s", e.Kind, e.Constraint)
+}
+
+func (e *ConstraintError) Is(target error) bool {
+	return target == e.Kind
+}
+
+func (e *ConstraintError) Unwrap() error {
+	return e.Err
+}
+
+type constraintField struct {
+	field   string
+	message string
+}
+
+// constraintFields maps constraint names from the migrations to the request
+// field they protect. Constraints not listed here are reported against their
+// column.
+var constraintFields = map[string]constraintField{
+	"users_email_key":        {"email", "a user with this email address already exists"},
+	"movies_runtime_check":   {"runtime", "must be a positive integer"},
+	"movies_year_check":      {"year", "must be between 1888 and the current year, or up to 10 years ahead if not released"},
+	"genres_length_check":    {"genres", "must contain between 1 and 5 genres"},
+	"movies_status_check":    {"status", "must be one of " + strings.Join(ReleaseStatuses, ", ")},
+	"movies_created_by_fkey": {"created_by", "must refer to an existing user"},
+}
+
+func newConstraintError(kind error, constraint, table, column string, err error) *ConstraintError {
+	e := &ConstraintError{Kind: kind, Constraint: constraint, Table: table, Column: column, Err: err}
+
+	if f, ok := constraintFields[constraint]; ok {
+		e.Field, e.Message = f.field, f.message
+		return e
+	}
+
+	e.Field = column
+	if e.Field == "" {
+		e.Field = constraint
+	}
+
+	switch kind {
+	case ErrUniqueViolation:
+		e.Message = "already exists"
+	case ErrForeignKeyViolation:
+		e.Message = "must refer to an existing record"
+	case ErrNotNullViolation:
+		e.Message = "must be provided"
+	default:
+		e.Message = "is not valid"
+	}
+
+	return e
+}
+
+// violates reports whether err is a violation of the named constraint.
+func violates(err error, constraint string) bool {
+	var constraintErr *ConstraintError
+
+	return errors.As(err, &constraintErr) && constraintErr.Constraint == constraint
+}
+
+// mapPostgresError turns the SQLSTATE codes of a *pgconn.PgError into the
+// typed errors above. Other errors are returned unchanged.
+func mapPostgresError(err error) error {
+	var pgErr *pgconn.PgError
+
+	if !errors.As(err, &pgErr) {
+		return err
+	}
+
+	switch pgErr.Code {
+	case "23505":
+		return newConstraintError(ErrUniqueViolation, pgErr.ConstraintName, pgErr.TableName, pgErr.ColumnName, err)
+	case "23514":
+		return newConstraintError(ErrCheckViolation, pgErr.ConstraintName, pgErr.TableName, pgErr.ColumnName, err)
+	case "23503":
+		return newConstraintError(ErrForeignKeyViolation, pgErr.ConstraintName, pgErr.TableName, pgErr.ColumnName, err)
+	case "23502":
+		return newConstraintError(ErrNotNullViolation, pgErr.ConstraintName, pgErr.TableName, pgErr.ColumnName, err)
+	case "40001", "40P01":
+		return fmt.Errorf("%w: %w", ErrSerializationFailure, err)
+	default:
+		return err
+	}
+}
+
+// sqliteColumnRX extracts table.column from messages such as "UNIQUE
+// constraint failed: users.email".
+var sqliteColumnRX = regexp.MustCompile(`constraint failed: (\w+)\.(\w+)`)
+
+// mapSQLiteError does the same as mapPostgresError for SQLite, which reports
+// the constraint in its message. Unique constraints are given the name
+// Postgres would generate, table_column_key, so that both backends agree.
+func mapSQLiteError(err error) error {
+	var sqliteErr *sqlite.Error
+
+	if !errors.As(err, &sqliteErr) {
+		return err
+	}
+
+	var table, column string
+	if m := sqliteColumnRX.FindStringSubmatch(sqliteErr.Error()); m != nil {
+		table, column = m[1], m[2]
+	}
+
+	switch sqliteErr.Code() {
+	case sqlite3.SQLITE_CONSTRAINT_UNIQUE, sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY:
+		return newConstraintError(ErrUniqueViolation, table+"_"+column+"_key", table, column, err)
+	case sqlite3.SQLITE_CONSTRAINT_CHECK:
+		_, constraint, _ := strings.Cut(sqliteErr.Error(), "CHECK constraint failed: ")
+		constraint, _, _ = strings.Cut(constraint, " ")
+		return newConstraintError(ErrCheckViolation, constraint, "", "", err)
+	case sqlite3.SQLITE_CONSTRAINT_FOREIGNKEY:
+		return newConstraintError(ErrForeignKeyViolation, "", "", "", err)
+	case sqlite3.SQLITE_CONSTRAINT_NOTNULL:
+		return newConstraintError(ErrNotNullViolation, "", table, column, err)
+	}
+
+	if sqliteErr.Code()&0xff == sqlite3.SQLITE_BUSY {
+		return fmt.Errorf("%w: %w", ErrSerializationFailure, err)
+	}
+
+	return err
+}
@@ -0,0 +1,126 @@
+package data
+
+import (
+	"autherain/golang_arxiv/internal/pubsub"
+	"context"
+	"time"
+)
+
+// WithEvents returns models that publish an event on bus for every write that
+// makes cached state stale: movie updates and deletes, user updates and
+// purges, permission grants and token deletions. Writes made in a transaction are
+// published once it has finished.
+func (m Models) WithEvents(bus pubsub.Publisher) Models {
+	return m.decorate(func(m Models, pending *[]func()) Models {
+		layer := eventLayer{bus: bus, pending: pending}
+
+		m.Movies = eventMovieModel{MovieStore: m.Movies, eventLayer: layer}
+		m.Permissions = eventPermissionModel{PermissionStore: m.Permissions, eventLayer: layer}
+		m.Tokens = eventTokenModel{TokenStore: m.Tokens, eventLayer: layer}
+		m.Users = eventUserModel{UserStore: m.Users, eventLayer: layer}
+
+		return m
+	})
+}
+
+type eventLayer struct {
+	bus     pubsub.Publisher
+	pending *[]func()
+}
+
+// publish sends event once err is known to be nil, deferring it to the end
+// of the transaction when there is one.
+func (l eventLayer) publish(ctx context.Context, err error, event pubsub.Event) error {
+	if err != nil {
+		return err
+	}
+
+	// The request context may be cancelled by the time a deferred event
+	// is sent.
+	ctx = context.WithoutCancel(ctx)
+
+	if l.pending != nil {
+		*l.pending = append(*l.pending, func() { l.bus.Publish(ctx, event) })
+		return nil
+	}
+
+	l.bus.Publish(ctx, event)
+
+	return nil
+}
+
+type eventMovieModel struct {
+	MovieStore
+	eventLayer
+}
+
+func (m eventMovieModel) Update(ctx context.Context, movie *Movie) error {
+	err := m.MovieStore.Update(ctx, movie)
+	return m.publish(ctx, err, pubsub.Event{Kind: pubsub.MovieChanged, ID: movie.ID})
+}
+
+func (m eventMovieModel) Delete(ctx context.Context, id int64) error {
+	err := m.MovieStore.Delete(ctx, id)
+	return m.publish(ctx, err, pubsub.Event{Kind: pubsub.MovieChanged, ID: id})
+}
+
+type eventPermissionModel struct {
+	PermissionStore
+	eventLayer
+}
+
+func (m eventPermissionModel) AddForUser(ctx context.Context, userID int64, codes ...string) error {
+	err := m.PermissionStore.AddForUser(ctx, userID, codes...)
+	return m.publish(ctx, err, pubsub.Event{Kind: pubsub.PermissionsChanged, ID: userID})
+}
+
+type eventUserModel struct {
+	UserStore
+	eventLayer
+}
+
+func (m eventUserModel) Update(ctx context.Context, user *User) error {
+	err := m.UserStore.Update(ctx, user)
+	return m.publish(ctx, err, pubsub.Event{Kind: pubsub.UserChanged, ID: user.ID})
+}
+
+func (m eventUserModel) PurgeDeleted(ctx context.Context, before time.Time) ([]int64, error) {
+	ids, err := m.UserStore.PurgeDeleted(ctx, before)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, id := range ids {
+		m.publish(ctx, nil, pubsub.Event{Kind: pubsub.UserDeleted, ID: id})
+	}
+
+	return ids, nil
+}
+
+type eventTokenModel struct {
+	TokenStore
+	eventLayer
+}
+
+// Delete, DeleteByID and DeleteFamily publish the same event as
+// DeleteAllForUser for authentication tokens, since events do not carry
+// tokens: other processes drop every cached lookup for the user.
+func (m eventTokenModel) Delete(ctx context.Context, scope string, userID int64, tokenPlaintext string) error {
+	err := m.TokenStore.Delete(ctx, scope, userID, tokenPlaintext)
+	return m.publish(ctx, err, pubsub.Event{Kind: pubsub.TokensRevoked, ID: userID, Scope: ScopeAuthentication})
+}
+
+func (m eventTokenModel) DeleteByID(ctx context.Context, scope string, userID, id int64) error {
+	err := m.TokenStore.DeleteByID(ctx, scope, userID, id)
+	return m.publish(ctx, err, pubsub.Event{Kind: pubsub.TokensRevoked, ID: userID, Scope: ScopeAuthentication})
+}
+
+func (m eventTokenModel) DeleteFamily(ctx context.Context, userID int64, family string) error {
+	err := m.TokenStore.DeleteFamily(ctx, userID, family)
+	return m.publish(ctx, err, pubsub.Event{Kind: pubsub.TokensRevoked, ID: userID, Scope: ScopeAuthentication})
+}
+
+func (m eventTokenModel) DeleteAllForUser(ctx context.Context, scope string, userID int64) error {
+	err := m.TokenStore.DeleteAllForUser(ctx, scope, userID)
+	return m.publish(ctx, err, pubsub.Event{Kind: pubsub.TokensRevoked, ID: userID, Scope: scope})
+}
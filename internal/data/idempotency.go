@@ -0,0 +1,159 @@
+package data
+
+import (
+	"autherain/golang_arxiv/internal/validator"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+)
+
+var (
+	ErrIdempotencyKeyMismatch = errors.New("idempotency key reused with a different request")
+	ErrIdempotencyKeyInFlight = errors.New("idempotency key in flight")
+)
+
+// IdempotencyInFlightTimeout is how long a claimed key may stay without a
+// stored response before another request is allowed to take it over, so that
+// a crash mid-request does not block the key until it expires.
+const IdempotencyInFlightTimeout = time.Minute
+
+type IdempotentResponse struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+}
+
+func ValidateIdempotencyKey(v *validator.Validator, key string) {
+	v.Check(key != "", "idempotency_key", "must be provided")
+	v.Check(len(key) <= 255, "idempotency_key", "must not be more than 255 bytes long")
+}
+
+type IdempotencyModel struct {
+	DB      DBTX
+	Timeout time.Duration
+}
+
+// Begin claims key for userID. It returns a nil response when the caller now
+// owns the key and must run the request, the stored response when the same
+// request already completed, ErrIdempotencyKeyMismatch when the key was used
+// with a different fingerprint and ErrIdempotencyKeyInFlight when the first
+// request has not finished yet.
+func (m IdempotencyModel) Begin(ctx context.Context, userID int64, key string, fingerprint []byte, ttl time.Duration) (*IdempotentResponse, error) {
+	query := `
+        INSERT INTO idempotency_keys (user_id, key, fingerprint, expiry)
+        VALUES ($1, $2, $3, $4)
+        ON CONFLICT (user_id, key) DO UPDATE
+        SET fingerprint = EXCLUDED.fingerprint, status_code = NULL, response_headers = NULL,
+            response_body = NULL, created_at = NOW(), expiry = EXCLUDED.expiry
+        WHERE idempotency_keys.expiry <= NOW()
+        OR (idempotency_keys.status_code IS NULL AND idempotency_keys.created_at <= $5)
+        RETURNING true`
+
+	args := []any{userID, key, fingerprint, time.Now().Add(ttl), time.Now().Add(-IdempotencyInFlightTimeout)}
+
+	ctx, cancel := withOperation(ctx, "IdempotencyModel.Begin", m.Timeout)
+	defer cancel()
+
+	var claimed bool
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&claimed)
+	switch {
+	case err == nil:
+		return nil, nil
+	case !errors.Is(err, sql.ErrNoRows):
+		return nil, err
+	}
+
+	query = `
+        SELECT fingerprint, status_code, response_headers, response_body
+        FROM idempotency_keys
+        WHERE user_id = $1 AND key = $2`
+
+	var (
+		storedFingerprint []byte
+		statusCode        sql.NullInt32
+		headers           []byte
+		body              []byte
+	)
+
+	err = m.DB.QueryRowContext(ctx, query, userID, key).Scan(&storedFingerprint, &statusCode, &headers, &body)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			// The key expired and was purged between the two statements.
+			return nil, ErrIdempotencyKeyInFlight
+		default:
+			return nil, err
+		}
+	}
+
+	if string(storedFingerprint) != string(fingerprint) {
+		return nil, ErrIdempotencyKeyMismatch
+	}
+
+	if !statusCode.Valid {
+		return nil, ErrIdempotencyKeyInFlight
+	}
+
+	response := &IdempotentResponse{
+		StatusCode: int(statusCode.Int32),
+		Body:       body,
+	}
+
+	if len(headers) > 0 {
+		err = json.Unmarshal(headers, &response.Header)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return response, nil
+}
+
+func (m IdempotencyModel) Complete(ctx context.Context, userID int64, key string, response *IdempotentResponse) error {
+	headers, err := json.Marshal(response.Header)
+	if err != nil {
+		return err
+	}
+
+	query := `
+        UPDATE idempotency_keys
+        SET status_code = $1, response_headers = $2, response_body = $3
+        WHERE user_id = $4 AND key = $5`
+
+	args := []any{response.StatusCode, headers, response.Body, userID, key}
+
+	ctx, cancel := withOperation(ctx, "IdempotencyModel.Complete", m.Timeout)
+	defer cancel()
+
+	_, err = m.DB.ExecContext(ctx, query, args...)
+	return err
+}
+
+// Release forgets a key whose request failed, so that the client can retry it.
+func (m IdempotencyModel) Release(ctx context.Context, userID int64, key string) error {
+	query := `
+        DELETE FROM idempotency_keys
+        WHERE user_id = $1 AND key = $2 AND status_code IS NULL`
+
+	ctx, cancel := withOperation(ctx, "IdempotencyModel.Release", m.Timeout)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID, key)
+	return err
+}
+
+func (m IdempotencyModel) DeleteExpired(ctx context.Context) error {
+	query := `
+        DELETE FROM idempotency_keys
+        WHERE expiry <= NOW()`
+
+	ctx, cancel := withOperation(ctx, "IdempotencyModel.DeleteExpired", m.Timeout)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query)
+	return err
+}
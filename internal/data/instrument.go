@@ -0,0 +1,262 @@
+package data
+
+import (
+	"autherain/golang_arxiv/internal/observability"
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/stdlib"
+	"github.com/uptrace/opentelemetry-go-extra/otelzap"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.uber.org/zap"
+)
+
+// QueryConfig holds the settings applied to every statement run by the SQL
+// models.
+type QueryConfig struct {
+	// Timeout bounds each model operation; DefaultQueryTimeout when zero.
+	Timeout time.Duration
+
+	// Statements taking at least SlowThreshold are logged to Logger. Zero
+	// disables the slow-query log.
+	SlowThreshold time.Duration
+	Logger        *otelzap.Logger
+}
+
+// Rows is a *sql.Rows that reports the query it belongs to once it has been
+// read to the end or closed.
+type Rows struct {
+	*sql.Rows
+	count  int
+	mapErr func(error) error
+	finish func(rows int, err error)
+}
+
+func (r *Rows) Next() bool {
+	if r.Rows.Next() {
+		r.count++
+		return true
+	}
+
+	r.done()
+	return false
+}
+
+func (r *Rows) Err() error {
+	return r.mapErr(r.Rows.Err())
+}
+
+func (r *Rows) Close() error {
+	err := r.Rows.Close()
+	r.done()
+
+	return err
+}
+
+func (r *Rows) done() {
+	if r.finish != nil {
+		r.finish(r.count, r.Rows.Err())
+		r.finish = nil
+	}
+}
+
+// Row is a *sql.Row that reports the query it belongs to when it is scanned.
+type Row struct {
+	row    *sql.Row
+	mapErr func(error) error
+	finish func(rows int, err error)
+}
+
+func (r *Row) Scan(dest ...any) error {
+	err := r.mapErr(r.row.Scan(dest...))
+
+	switch {
+	case err == nil:
+		r.finish(1, nil)
+	case errors.Is(err, sql.ErrNoRows):
+		r.finish(0, nil)
+	default:
+		r.finish(0, err)
+	}
+
+	return err
+}
+
+func (r *Row) Err() error {
+	return r.mapErr(r.row.Err())
+}
+
+// sqlHandle is the part of *sql.DB and *txConn that instrumentedDB wraps.
+type sqlHandle interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// instrumentedDB runs every statement in a span, records its latency in the
+// db_query_duration_seconds histogram and logs it when it is slow. Statements
+// are named after the operation given to withOperation by the model method
+// that ran them. Driver errors are translated by mapErr into the typed
+// errors in errors.go.
+type instrumentedDB struct {
+	db     sqlHandle
+	system string
+	pool   string
+	config QueryConfig
+	mapErr func(error) error
+}
+
+func instrument(db sqlHandle, system, pool string, config QueryConfig) DBTX {
+	mapErr := mapPostgresError
+	if system == "sqlite" {
+		mapErr = mapSQLiteError
+	}
+
+	return instrumentedDB{db: db, system: system, pool: pool, config: config, mapErr: mapErr}
+}
+
+func (db instrumentedDB) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	ctx, finish := db.start(ctx, query)
+
+	result, err := db.db.ExecContext(ctx, query, args...)
+	err = db.mapErr(err)
+
+	rows := 0
+	if err == nil {
+		if n, err := result.RowsAffected(); err == nil {
+			rows = int(n)
+		}
+	}
+
+	finish(rows, err)
+
+	return result, err
+}
+
+func (db instrumentedDB) QueryContext(ctx context.Context, query string, args ...any) (*Rows, error) {
+	ctx, finish := db.start(ctx, query)
+
+	rows, err := db.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		err = db.mapErr(err)
+		finish(0, err)
+		return nil, err
+	}
+
+	return &Rows{Rows: rows, mapErr: db.mapErr, finish: finish}, nil
+}
+
+func (db instrumentedDB) QueryRowContext(ctx context.Context, query string, args ...any) *Row {
+	ctx, finish := db.start(ctx, query)
+
+	return &Row{row: db.db.QueryRowContext(ctx, query, args...), mapErr: db.mapErr, finish: finish}
+}
+
+// ErrRawUnsupported is returned by Raw when the database is not Postgres.
+var ErrRawUnsupported = errors.New("raw connection access requires postgres")
+
+func (db instrumentedDB) Raw(ctx context.Context, statement string, fn func(ctx context.Context, conn *pgx.Conn) (int, error)) error {
+	if db.system != "postgresql" {
+		return ErrRawUnsupported
+	}
+
+	ctx, finish := db.start(ctx, statement)
+
+	var conn *sql.Conn
+
+	switch handle := db.db.(type) {
+	case *txConn:
+		conn = handle.conn
+	case *sql.DB:
+		var err error
+
+		conn, err = handle.Conn(ctx)
+		if err != nil {
+			err = db.mapErr(err)
+			finish(0, err)
+			return err
+		}
+
+		defer conn.Close()
+	}
+
+	rows := 0
+
+	err := conn.Raw(func(driverConn any) error {
+		pgxConn := driverConn.(*stdlib.Conn).Conn()
+
+		if pgxConn.PgConn().TxStatus() != 'I' {
+			var err error
+			rows, err = fn(ctx, pgxConn)
+			return err
+		}
+
+		return pgx.BeginFunc(ctx, pgxConn, func(tx pgx.Tx) error {
+			var err error
+			rows, err = fn(ctx, tx.Conn())
+			return err
+		})
+	})
+	err = db.mapErr(err)
+
+	if err != nil {
+		rows = 0
+	}
+
+	finish(rows, err)
+
+	return err
+}
+
+func (db instrumentedDB) start(ctx context.Context, query string) (context.Context, func(rows int, err error)) {
+	operation := operationName(ctx)
+	started := time.Now()
+
+	ctx, span := observability.StartSpan(ctx, "db "+operation)
+
+	span.SetAttributes(
+		attribute.String("db.system", db.system),
+		attribute.String("db.operation", operation),
+		attribute.String("db.pool", db.pool),
+		attribute.String("db.statement", compactStatement(query)),
+	)
+
+	return ctx, func(rows int, err error) {
+		duration := time.Since(started)
+
+		span.SetAttributes(attribute.Int("db.rows", rows))
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+
+		observability.RecordHistogram(ctx, "db_query_duration_seconds", duration.Seconds(),
+			attribute.String("operation", operation),
+			attribute.String("pool", db.pool),
+			attribute.Bool("error", err != nil),
+		)
+
+		if db.config.Logger != nil && db.config.SlowThreshold > 0 && duration >= db.config.SlowThreshold {
+			db.config.Logger.Ctx(ctx).Warn("slow query",
+				zap.String("operation", operation),
+				zap.String("pool", db.pool),
+				zap.Duration("duration", duration),
+				zap.Int("rows", rows),
+				zap.String("statement", compactStatement(query)),
+				zap.Error(err),
+			)
+		}
+	}
+}
+
+// compactStatement collapses the indentation of a query so that it reads as a
+// single line in spans and logs.
+func compactStatement(query string) string {
+	return strings.Join(strings.Fields(query), " ")
+}
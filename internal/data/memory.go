@@ -0,0 +1,1504 @@
+package data
+
+import (
+	"autherain/golang_arxiv/internal/validator"
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// memoryStore holds the state shared by the in-memory models. A single lock
+// guards every collection so that cross-model lookups such as GetForToken
+// see a consistent view, the same way a single Postgres query would.
+type memoryStore struct {
+	mu sync.RWMutex
+	memoryData
+
+	// saved holds, during a transaction, the tables it has written to as
+	// they were before its first write, so that they can be put back if it
+	// fails.
+	saved *memorySaved
+}
+
+// memoryTable is a set of tables, each covering the collections and ID
+// counters that are written together.
+type memoryTable uint
+
+const (
+	memoryMovies memoryTable = 1 << iota // movies, nextMovieID and changes
+	memoryUsers
+	memoryTokens
+	memoryPermissions
+	memoryIdempotency
+	memoryAudit
+	memoryDenylist
+	memoryAPIKeys
+	memoryIdentities
+	memoryOIDCLogins
+)
+
+type memorySaved struct {
+	tables memoryTable
+	data   memoryData
+}
+
+type memoryData struct {
+	movies      map[int64]*Movie
+	nextMovieID int64
+	changes     []memoryChange
+
+	users      map[int64]*User
+	nextUserID int64
+
+	tokens          map[string]*Token
+	nextTokenID     int64
+	permissionCodes []string
+	permissions     map[int64]Permissions
+
+	idempotency map[memoryIdempotencyKey]*memoryIdempotencyRecord
+
+	audit []AuditEntry
+
+	denylist map[string]time.Time
+
+	apiKeys      map[string]*APIKey
+	nextAPIKeyID int64
+
+	identities map[memoryIdentityKey]*Identity
+	oidcLogins map[string]*OIDCLogin
+}
+
+type memoryIdentityKey struct {
+	issuer  string
+	subject string
+}
+
+type memoryChange struct {
+	seq       int64
+	movieID   int64
+	operation string
+	changedAt time.Time
+}
+
+type memoryIdempotencyKey struct {
+	userID int64
+	key    string
+}
+
+type memoryIdempotencyRecord struct {
+	fingerprint []byte
+	response    *IdempotentResponse
+	createdAt   time.Time
+	expiry      time.Time
+}
+
+// NewMemoryModels returns models backed by process memory. Nothing survives a
+// restart; it is intended for tests, demos and running without Postgres.
+func NewMemoryModels() Models {
+	store := &memoryStore{
+		memoryData: memoryData{
+			movies:          make(map[int64]*Movie),
+			users:           make(map[int64]*User),
+			tokens:          make(map[string]*Token),
+			permissionCodes: []string{"movies:read", "movies:write", "movies:admin"},
+			permissions:     make(map[int64]Permissions),
+			idempotency:     make(map[memoryIdempotencyKey]*memoryIdempotencyRecord),
+			denylist:        make(map[string]time.Time),
+			apiKeys:         make(map[string]*APIKey),
+			identities:      make(map[memoryIdentityKey]*Identity),
+			oidcLogins:      make(map[string]*OIDCLogin),
+		},
+	}
+
+	models := store.models(false)
+	models.transact = store.transact
+
+	return models
+}
+
+func (s *memoryStore) models(inTx bool) Models {
+	return Models{
+		APIKeys:      memoryAPIKeyModel{s, inTx},
+		Audit:        memoryAuditModel{s, inTx},
+		Denylist:     memoryDenylistModel{s, inTx},
+		Idempotency:  memoryIdempotencyModel{s, inTx},
+		Identities:   memoryIdentityModel{s, inTx},
+		Movies:       memoryMovieModel{s, inTx},
+		MovieChanges: memoryMovieChangeModel{s, inTx},
+		OIDCLogins:   memoryOIDCLoginModel{s, inTx},
+		Permissions:  memoryPermissionModel{s, inTx},
+		Tokens:       memoryTokenModel{s, inTx},
+		Users:        memoryUserModel{s, inTx},
+	}
+}
+
+// transact holds the write lock for the whole of fn, which gives the same
+// isolation as a serializable transaction, and puts the data back the way it
+// was if fn fails. The models passed to fn skip locking because the lock is
+// already held; each table is copied the first time they write to it.
+func (s *memoryStore) transact(ctx context.Context, fn func(Models) error) (err error) {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.saved = &memorySaved{}
+
+	defer func() {
+		saved := s.saved
+		s.saved = nil
+
+		if p := recover(); p != nil {
+			s.restore(saved)
+			panic(p)
+		}
+
+		if err != nil {
+			s.restore(saved)
+		}
+	}()
+
+	models := s.models(true)
+	models.transact = joinTx(models)
+
+	return fn(models)
+}
+
+// lock takes the write lock for a change to tables. Inside a transaction the
+// lock is already held, and the tables are saved instead if this is the
+// first change to them.
+func (s *memoryStore) lock(inTx bool, tables memoryTable) func() {
+	if inTx {
+		s.save(tables)
+		return func() {}
+	}
+
+	s.mu.Lock()
+	return s.mu.Unlock
+}
+
+func (s *memoryStore) rlock(inTx bool) func() {
+	if inTx {
+		return func() {}
+	}
+
+	s.mu.RLock()
+	return s.mu.RUnlock
+}
+
+// save copies the tables not yet saved by the current transaction, sharing
+// nothing the models modify in place.
+func (s *memoryStore) save(tables memoryTable) {
+	tables &^= s.saved.tables
+	s.saved.tables |= tables
+
+	data := &s.saved.data
+
+	if tables&memoryMovies != 0 {
+		data.movies = make(map[int64]*Movie, len(s.movies))
+		for id, movie := range s.movies {
+			data.movies[id] = cloneMovie(movie)
+		}
+
+		data.nextMovieID = s.nextMovieID
+		data.changes = append([]memoryChange(nil), s.changes...)
+	}
+
+	if tables&memoryUsers != 0 {
+		data.users = make(map[int64]*User, len(s.users))
+		for id, user := range s.users {
+			clone := *user
+			data.users[id] = &clone
+		}
+
+		data.nextUserID = s.nextUserID
+	}
+
+	if tables&memoryTokens != 0 {
+		data.tokens = make(map[string]*Token, len(s.tokens))
+		for hash, token := range s.tokens {
+			clone := *token
+			data.tokens[hash] = &clone
+		}
+
+		data.nextTokenID = s.nextTokenID
+	}
+
+	if tables&memoryPermissions != 0 {
+		data.permissions = make(map[int64]Permissions, len(s.permissions))
+		for id, permissions := range s.permissions {
+			data.permissions[id] = append(Permissions(nil), permissions...)
+		}
+	}
+
+	if tables&memoryIdempotency != 0 {
+		data.idempotency = make(map[memoryIdempotencyKey]*memoryIdempotencyRecord, len(s.idempotency))
+		for k, record := range s.idempotency {
+			clone := *record
+			data.idempotency[k] = &clone
+		}
+	}
+
+	if tables&memoryAudit != 0 {
+		data.audit = append([]AuditEntry(nil), s.audit...)
+	}
+
+	if tables&memoryDenylist != 0 {
+		data.denylist = make(map[string]time.Time, len(s.denylist))
+		for key, expiry := range s.denylist {
+			data.denylist[key] = expiry
+		}
+	}
+
+	if tables&memoryAPIKeys != 0 {
+		data.apiKeys = make(map[string]*APIKey, len(s.apiKeys))
+		for hash, key := range s.apiKeys {
+			data.apiKeys[hash] = cloneAPIKey(key)
+		}
+
+		data.nextAPIKeyID = s.nextAPIKeyID
+	}
+
+	if tables&memoryIdentities != 0 {
+		data.identities = make(map[memoryIdentityKey]*Identity, len(s.identities))
+		for k, identity := range s.identities {
+			clone := *identity
+			data.identities[k] = &clone
+		}
+	}
+
+	if tables&memoryOIDCLogins != 0 {
+		data.oidcLogins = make(map[string]*OIDCLogin, len(s.oidcLogins))
+		for state, login := range s.oidcLogins {
+			clone := *login
+			data.oidcLogins[state] = &clone
+		}
+	}
+}
+
+// restore puts back the tables saved by a failed transaction.
+func (s *memoryStore) restore(saved *memorySaved) {
+	data := &saved.data
+
+	if saved.tables&memoryMovies != 0 {
+		s.movies, s.nextMovieID, s.changes = data.movies, data.nextMovieID, data.changes
+	}
+	if saved.tables&memoryUsers != 0 {
+		s.users, s.nextUserID = data.users, data.nextUserID
+	}
+	if saved.tables&memoryTokens != 0 {
+		s.tokens, s.nextTokenID = data.tokens, data.nextTokenID
+	}
+	if saved.tables&memoryPermissions != 0 {
+		s.permissions = data.permissions
+	}
+	if saved.tables&memoryIdempotency != 0 {
+		s.idempotency = data.idempotency
+	}
+	if saved.tables&memoryAudit != 0 {
+		s.audit = data.audit
+	}
+	if saved.tables&memoryDenylist != 0 {
+		s.denylist = data.denylist
+	}
+	if saved.tables&memoryAPIKeys != 0 {
+		s.apiKeys, s.nextAPIKeyID = data.apiKeys, data.nextAPIKeyID
+	}
+	if saved.tables&memoryIdentities != 0 {
+		s.identities = data.identities
+	}
+	if saved.tables&memoryOIDCLogins != 0 {
+		s.oidcLogins = data.oidcLogins
+	}
+}
+
+// memoryNow matches the one-second precision of the timestamp(0) columns.
+func memoryNow() time.Time {
+	return time.Now().Round(time.Second)
+}
+
+func cloneMovie(movie *Movie) *Movie {
+	clone := *movie
+
+	if movie.Genres != nil {
+		clone.Genres = append([]string(nil), movie.Genres...)
+	}
+
+	if movie.ReleaseDates != nil {
+		clone.ReleaseDates = make(ReleaseDates, len(movie.ReleaseDates))
+		for country, date := range movie.ReleaseDates {
+			clone.ReleaseDates[country] = date
+		}
+	}
+
+	if movie.CreatedBy != nil {
+		createdBy := *movie.CreatedBy
+		clone.CreatedBy = &createdBy
+	}
+
+	return &clone
+}
+
+func (s *memoryStore) logChange(movieID int64, operation string, changedAt time.Time) {
+	s.changes = append(s.changes, memoryChange{
+		seq:       int64(len(s.changes)) + 1,
+		movieID:   movieID,
+		operation: operation,
+		changedAt: changedAt,
+	})
+}
+
+type memoryMovieModel struct {
+	store *memoryStore
+	inTx  bool
+}
+
+func (m memoryMovieModel) Insert(ctx context.Context, movie *Movie) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	defer m.store.lock(m.inTx, memoryMovies)()
+
+	m.store.nextMovieID++
+
+	movie.ID = m.store.nextMovieID
+	movie.CreatedAt = memoryNow()
+	movie.UpdatedAt = movie.CreatedAt
+	movie.Version = 1
+
+	m.store.movies[movie.ID] = cloneMovie(movie)
+	m.store.logChange(movie.ID, ChangeCreated, movie.CreatedAt)
+
+	return nil
+}
+
+func (m memoryMovieModel) InsertMany(ctx context.Context, movies []*Movie) error {
+	for _, movie := range movies {
+		err := m.Insert(ctx, movie)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m memoryMovieModel) Get(ctx context.Context, id int64) (*Movie, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	defer m.store.rlock(m.inTx)()
+
+	movie, ok := m.store.movies[id]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+
+	return cloneMovie(movie), nil
+}
+
+func (m memoryMovieModel) Update(ctx context.Context, movie *Movie) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	defer m.store.lock(m.inTx, memoryMovies)()
+
+	stored, ok := m.store.movies[movie.ID]
+	if !ok || stored.Version != movie.Version {
+		return ErrEditConflict
+	}
+
+	movie.UpdatedAt = memoryNow()
+	movie.Version++
+
+	updated := cloneMovie(movie)
+	updated.CreatedAt = stored.CreatedAt
+	updated.CreatedBy = stored.CreatedBy
+
+	m.store.movies[movie.ID] = updated
+	m.store.logChange(movie.ID, ChangeUpdated, movie.UpdatedAt)
+
+	return nil
+}
+
+func (m memoryMovieModel) Delete(ctx context.Context, id int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	defer m.store.lock(m.inTx, memoryMovies)()
+
+	if _, ok := m.store.movies[id]; !ok {
+		return ErrRecordNotFound
+	}
+
+	delete(m.store.movies, id)
+	m.store.logChange(id, ChangeDeleted, memoryNow())
+
+	return nil
+}
+
+func (m memoryMovieModel) GetAll(ctx context.Context, title string, genres []string, filters Filters) ([]*Movie, Metadata, error) {
+	return m.list(ctx, filters, func(movie *Movie) bool {
+		return matchesTitle(movie.Title, title) && containsAll(movie.Genres, genres)
+	})
+}
+
+func (m memoryMovieModel) GetUpcoming(ctx context.Context, country string, filters Filters) ([]*Movie, Metadata, error) {
+	return m.list(ctx, filters, func(movie *Movie) bool {
+		if !validator.PermittedValue(movie.Status, UpcomingStatuses...) {
+			return false
+		}
+
+		_, ok := movie.ReleaseDates[country]
+		return ok || country == ""
+	})
+}
+
+func (m memoryMovieModel) GetAllForOwner(ctx context.Context, userID int64, filters Filters) ([]*Movie, Metadata, error) {
+	return m.list(ctx, filters, func(movie *Movie) bool {
+		return movie.OwnedBy(userID)
+	})
+}
+
+func (m memoryMovieModel) list(ctx context.Context, filters Filters, match func(*Movie) bool) ([]*Movie, Metadata, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	compare, err := movieComparison(filters.sortColumn())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	direction := filters.sortDirection()
+
+	unlock := m.store.rlock(m.inTx)
+
+	matched := []*Movie{}
+	for _, movie := range m.store.movies {
+		if match(movie) {
+			matched = append(matched, cloneMovie(movie))
+		}
+	}
+
+	unlock()
+
+	sort.Slice(matched, func(i, j int) bool {
+		c := compare(matched[i], matched[j])
+		if direction == "DESC" {
+			c = -c
+		}
+
+		if c != 0 {
+			return c < 0
+		}
+
+		return matched[i].ID < matched[j].ID
+	})
+
+	totalRecords := len(matched)
+
+	start := min(filters.offset(), totalRecords)
+	end := min(start+filters.limit(), totalRecords)
+
+	return matched[start:end], calculateMetadata(totalRecords, filters.Page, filters.PageSize), nil
+}
+
+// movieComparison returns the comparison of movies by column. The handlers
+// only let columns from their safelist through, but the store must not rely
+// on those matching what it can sort by.
+func movieComparison(column string) (func(a, b *Movie) int, error) {
+	switch column {
+	case "id":
+		return func(a, b *Movie) int { return cmp.Compare(a.ID, b.ID) }, nil
+	case "title":
+		return func(a, b *Movie) int { return strings.Compare(a.Title, b.Title) }, nil
+	case "year":
+		return func(a, b *Movie) int { return cmp.Compare(a.Year, b.Year) }, nil
+	case "runtime":
+		return func(a, b *Movie) int { return cmp.Compare(a.Runtime, b.Runtime) }, nil
+	case "updated_at":
+		return func(a, b *Movie) int { return a.UpdatedAt.Compare(b.UpdatedAt) }, nil
+	default:
+		return nil, fmt.Errorf("unsupported sort column %q", column)
+	}
+}
+
+// matchesTitle mirrors to_tsvector('simple', title) @@ plainto_tsquery('simple', query):
+// every word of the query must appear in the title, ignoring case.
+func matchesTitle(title, query string) bool {
+	if query == "" {
+		return true
+	}
+
+	words := textSearchWords(query)
+	if len(words) == 0 {
+		return false
+	}
+
+	return containsAll(textSearchWords(title), words)
+}
+
+func textSearchWords(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+func containsAll(values, required []string) bool {
+	for _, r := range required {
+		found := false
+		for _, v := range values {
+			if v == r {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+type memoryMovieChangeModel struct {
+	store *memoryStore
+	inTx  bool
+}
+
+// Since treats every change as its own transaction: changes are appended
+// under the store lock, so their sequence number is also their commit order.
+func (m memoryMovieChangeModel) Since(ctx context.Context, token ChangeToken, limit int) ([]*MovieChange, ChangeToken, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, token, false, err
+	}
+
+	defer m.store.rlock(m.inTx)()
+
+	var (
+		next    = token
+		hasMore = false
+		changes = []*MovieChange{}
+		latest  = make(map[int64]int)
+	)
+
+	for _, entry := range m.store.changes {
+		if entry.seq <= token.ID {
+			continue
+		}
+
+		if len(changes) == limit {
+			hasMore = true
+			break
+		}
+
+		next = ChangeToken{TxID: uint64(entry.seq), ID: entry.seq}
+
+		if i, ok := latest[entry.movieID]; ok {
+			changes[i] = nil
+		}
+
+		change := &MovieChange{
+			MovieID:   entry.movieID,
+			Operation: entry.operation,
+			ChangedAt: entry.changedAt,
+		}
+
+		if movie, ok := m.store.movies[entry.movieID]; ok {
+			change.Movie = cloneMovie(movie)
+		}
+
+		latest[entry.movieID] = len(changes)
+		changes = append(changes, change)
+	}
+
+	compacted := changes[:0]
+	for _, change := range changes {
+		if change != nil {
+			compacted = append(compacted, change)
+		}
+	}
+
+	return compacted, next, hasMore, nil
+}
+
+type memoryUserModel struct {
+	store *memoryStore
+	inTx  bool
+}
+
+func (m memoryUserModel) emailTaken(email string, exceptID int64) bool {
+	for _, user := range m.store.users {
+		if user.ID != exceptID && strings.EqualFold(user.Email, email) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (m memoryUserModel) Insert(ctx context.Context, user *User) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	defer m.store.lock(m.inTx, memoryUsers)()
+
+	if m.emailTaken(user.Email, 0) {
+		return ErrDuplicateEmail
+	}
+
+	m.store.nextUserID++
+
+	user.ID = m.store.nextUserID
+	user.CreatedAt = memoryNow()
+	user.Version = 1
+
+	stored := *user
+	m.store.users[user.ID] = &stored
+
+	return nil
+}
+
+func (m memoryUserModel) Get(ctx context.Context, id int64) (*User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	defer m.store.rlock(m.inTx)()
+
+	user, ok := m.store.users[id]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+
+	found := *user
+	return &found, nil
+}
+
+func (m memoryUserModel) GetByEmail(ctx context.Context, email string) (*User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	defer m.store.rlock(m.inTx)()
+
+	for _, user := range m.store.users {
+		if strings.EqualFold(user.Email, email) {
+			found := *user
+			return &found, nil
+		}
+	}
+
+	return nil, ErrRecordNotFound
+}
+
+func (m memoryUserModel) Update(ctx context.Context, user *User) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	defer m.store.lock(m.inTx, memoryUsers)()
+
+	stored, ok := m.store.users[user.ID]
+	if !ok || stored.Version != user.Version {
+		return ErrEditConflict
+	}
+
+	if m.emailTaken(user.Email, user.ID) {
+		return ErrDuplicateEmail
+	}
+
+	user.Version++
+
+	updated := *user
+	updated.CreatedAt = stored.CreatedAt
+
+	if user.DeletionRequestedAt != nil {
+		requestedAt := user.DeletionRequestedAt.Round(time.Second)
+		updated.DeletionRequestedAt = &requestedAt
+	}
+
+	m.store.users[user.ID] = &updated
+
+	return nil
+}
+
+func (m memoryUserModel) PurgeDeleted(ctx context.Context, before time.Time) ([]int64, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	defer m.store.lock(m.inTx, memoryUsers|memoryMovies|memoryTokens|memoryIdempotency|memoryAPIKeys|memoryIdentities|memoryPermissions)()
+
+	var ids []int64
+
+	for id, user := range m.store.users {
+		if user.DeletionRequestedAt != nil && !user.DeletionRequestedAt.After(before) {
+			ids = append(ids, id)
+		}
+	}
+
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	now := memoryNow()
+
+	for _, id := range ids {
+		for _, movie := range m.store.movies {
+			if movie.CreatedBy != nil && *movie.CreatedBy == id {
+				movie.CreatedBy = nil
+				movie.UpdatedAt = now
+				movie.Version++
+				m.store.logChange(movie.ID, ChangeUpdated, now)
+			}
+		}
+
+		for hash, token := range m.store.tokens {
+			if token.UserID == id {
+				delete(m.store.tokens, hash)
+			}
+		}
+
+		for k := range m.store.idempotency {
+			if k.userID == id {
+				delete(m.store.idempotency, k)
+			}
+		}
+
+		for hash, key := range m.store.apiKeys {
+			if key.UserID == id {
+				delete(m.store.apiKeys, hash)
+			}
+		}
+
+		for k, identity := range m.store.identities {
+			if identity.UserID == id {
+				delete(m.store.identities, k)
+			}
+		}
+
+		delete(m.store.permissions, id)
+		delete(m.store.users, id)
+	}
+
+	return ids, nil
+}
+
+func (m memoryUserModel) GetForToken(ctx context.Context, tokenScope, tokenPlaintext string) (*User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	defer m.store.rlock(m.inTx)()
+
+	token, ok := m.store.tokens[string(tokenHash[:])]
+	if !ok || token.Scope != tokenScope || !token.Expiry.After(time.Now()) {
+		return nil, ErrRecordNotFound
+	}
+
+	user, ok := m.store.users[token.UserID]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+
+	found := *user
+	return &found, nil
+}
+
+type memoryTokenModel struct {
+	store *memoryStore
+	inTx  bool
+}
+
+func (m memoryTokenModel) New(ctx context.Context, userID int64, ttl time.Duration, scope string) (*Token, error) {
+	token, err := GenerateToken(userID, ttl, scope)
+	if err != nil {
+		return nil, err
+	}
+
+	err = m.Insert(ctx, token)
+	return token, err
+}
+
+func (m memoryTokenModel) Insert(ctx context.Context, token *Token) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	defer m.store.lock(m.inTx, memoryTokens)()
+
+	m.store.nextTokenID++
+
+	token.ID = m.store.nextTokenID
+	token.CreatedAt = memoryNow()
+
+	stored := *token
+	stored.Plaintext = ""
+	stored.Expiry = token.Expiry.Round(time.Second)
+
+	m.store.tokens[string(token.Hash)] = &stored
+
+	return nil
+}
+
+func (m memoryTokenModel) Touch(ctx context.Context, tokenPlaintext, ip, userAgent string, notBefore time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	defer m.store.lock(m.inTx, memoryTokens)()
+
+	token, ok := m.store.tokens[string(tokenHash[:])]
+	if !ok || (token.LastUsedAt != nil && !token.LastUsedAt.Before(notBefore)) {
+		return nil
+	}
+
+	now := memoryNow()
+
+	token.LastUsedAt = &now
+	token.IP = ip
+	token.UserAgent = userAgent
+
+	return nil
+}
+
+func (m memoryTokenModel) Delete(ctx context.Context, scope string, userID int64, tokenPlaintext string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	defer m.store.lock(m.inTx, memoryTokens)()
+
+	token, ok := m.store.tokens[string(tokenHash[:])]
+	if !ok || token.Scope != scope || token.UserID != userID {
+		return ErrRecordNotFound
+	}
+
+	m.deleteWithFamily(string(tokenHash[:]), token)
+
+	return nil
+}
+
+func (m memoryTokenModel) DeleteByID(ctx context.Context, scope string, userID, id int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	defer m.store.lock(m.inTx, memoryTokens)()
+
+	for hash, token := range m.store.tokens {
+		if token.ID == id && token.Scope == scope && token.UserID == userID {
+			m.deleteWithFamily(hash, token)
+			return nil
+		}
+	}
+
+	return ErrRecordNotFound
+}
+
+func (m memoryTokenModel) deleteWithFamily(hash string, token *Token) {
+	delete(m.store.tokens, hash)
+
+	if token.Family != "" {
+		m.deleteFamily(token.UserID, token.Family)
+	}
+}
+
+func (m memoryTokenModel) deleteFamily(userID int64, family string) {
+	for hash, token := range m.store.tokens {
+		if token.UserID == userID && token.Family == family {
+			delete(m.store.tokens, hash)
+		}
+	}
+}
+
+func (m memoryTokenModel) DeleteFamily(ctx context.Context, userID int64, family string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	defer m.store.lock(m.inTx, memoryTokens)()
+
+	m.deleteFamily(userID, family)
+
+	return nil
+}
+
+func (m memoryTokenModel) GetByPlaintext(ctx context.Context, scope, tokenPlaintext string) (*Token, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	defer m.store.rlock(m.inTx)()
+
+	token, ok := m.store.tokens[string(tokenHash[:])]
+	if !ok || token.Scope != scope || !token.Expiry.After(time.Now()) {
+		return nil, ErrRecordNotFound
+	}
+
+	found := *token
+	return &found, nil
+}
+
+func (m memoryTokenModel) MarkRotated(ctx context.Context, id int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	defer m.store.lock(m.inTx, memoryTokens)()
+
+	for _, token := range m.store.tokens {
+		if token.ID == id && token.RotatedAt == nil {
+			now := memoryNow()
+			token.RotatedAt = &now
+			return nil
+		}
+	}
+
+	return ErrEditConflict
+}
+
+func (m memoryTokenModel) DeleteAllForUser(ctx context.Context, scope string, userID int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	defer m.store.lock(m.inTx, memoryTokens)()
+
+	for hash, token := range m.store.tokens {
+		if token.Scope == scope && token.UserID == userID {
+			delete(m.store.tokens, hash)
+		}
+	}
+
+	return nil
+}
+
+func (m memoryTokenModel) GetAllForUser(ctx context.Context, userID int64) ([]*Token, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	defer m.store.rlock(m.inTx)()
+
+	tokens := []*Token{}
+	now := time.Now()
+
+	for _, token := range m.store.tokens {
+		if token.UserID == userID && token.Expiry.After(now) {
+			found := *token
+			tokens = append(tokens, &found)
+		}
+	}
+
+	sort.Slice(tokens, func(i, j int) bool {
+		if !tokens[i].CreatedAt.Equal(tokens[j].CreatedAt) {
+			return tokens[i].CreatedAt.After(tokens[j].CreatedAt)
+		}
+		return tokens[i].ID > tokens[j].ID
+	})
+
+	return tokens, nil
+}
+
+type memoryPermissionModel struct {
+	store *memoryStore
+	inTx  bool
+}
+
+func (m memoryPermissionModel) GetAllForUser(ctx context.Context, userID int64) (Permissions, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	defer m.store.rlock(m.inTx)()
+
+	if _, ok := m.store.users[userID]; !ok {
+		return nil, nil
+	}
+
+	return append(Permissions(nil), m.store.permissions[userID]...), nil
+}
+
+// AddForUser silently skips unknown codes, like the INSERT ... SELECT of the
+// Postgres model, and fails on codes the user already holds, like its
+// primary key.
+func (m memoryPermissionModel) AddForUser(ctx context.Context, userID int64, codes ...string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	defer m.store.lock(m.inTx, memoryPermissions)()
+
+	if _, ok := m.store.users[userID]; !ok {
+		return ErrRecordNotFound
+	}
+
+	permissions := m.store.permissions[userID]
+
+	for _, code := range codes {
+		if !validator.PermittedValue(code, m.store.permissionCodes...) {
+			continue
+		}
+
+		if permissions.Include(code) {
+			return fmt.Errorf("user %d already holds permission %q", userID, code)
+		}
+
+		permissions = append(permissions, code)
+	}
+
+	m.store.permissions[userID] = permissions
+
+	return nil
+}
+
+type memoryIdempotencyModel struct {
+	store *memoryStore
+	inTx  bool
+}
+
+func (m memoryIdempotencyModel) Begin(ctx context.Context, userID int64, key string, fingerprint []byte, ttl time.Duration) (*IdempotentResponse, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	defer m.store.lock(m.inTx, memoryIdempotency)()
+
+	now := time.Now()
+	k := memoryIdempotencyKey{userID: userID, key: key}
+
+	record, ok := m.store.idempotency[k]
+
+	stale := ok && record.response == nil && !record.createdAt.After(now.Add(-IdempotencyInFlightTimeout))
+	if !ok || !record.expiry.After(now) || stale {
+		m.store.idempotency[k] = &memoryIdempotencyRecord{
+			fingerprint: append([]byte(nil), fingerprint...),
+			createdAt:   now,
+			expiry:      now.Add(ttl),
+		}
+		return nil, nil
+	}
+
+	if !bytes.Equal(record.fingerprint, fingerprint) {
+		return nil, ErrIdempotencyKeyMismatch
+	}
+
+	if record.response == nil {
+		return nil, ErrIdempotencyKeyInFlight
+	}
+
+	response := *record.response
+	response.Header = record.response.Header.Clone()
+	response.Body = append([]byte(nil), record.response.Body...)
+
+	return &response, nil
+}
+
+func (m memoryIdempotencyModel) Complete(ctx context.Context, userID int64, key string, response *IdempotentResponse) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	defer m.store.lock(m.inTx, memoryIdempotency)()
+
+	record, ok := m.store.idempotency[memoryIdempotencyKey{userID: userID, key: key}]
+	if !ok {
+		return nil
+	}
+
+	stored := *response
+	stored.Header = response.Header.Clone()
+	stored.Body = append([]byte(nil), response.Body...)
+
+	record.response = &stored
+
+	return nil
+}
+
+func (m memoryIdempotencyModel) Release(ctx context.Context, userID int64, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	defer m.store.lock(m.inTx, memoryIdempotency)()
+
+	k := memoryIdempotencyKey{userID: userID, key: key}
+
+	if record, ok := m.store.idempotency[k]; ok && record.response == nil {
+		delete(m.store.idempotency, k)
+	}
+
+	return nil
+}
+
+func (m memoryIdempotencyModel) DeleteExpired(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	defer m.store.lock(m.inTx, memoryIdempotency)()
+
+	now := time.Now()
+
+	for k, record := range m.store.idempotency {
+		if !record.expiry.After(now) {
+			delete(m.store.idempotency, k)
+		}
+	}
+
+	return nil
+}
+
+type memoryAPIKeyModel struct {
+	store *memoryStore
+	inTx  bool
+}
+
+func cloneAPIKey(key *APIKey) *APIKey {
+	clone := *key
+	clone.Permissions = append(Permissions(nil), key.Permissions...)
+	return &clone
+}
+
+func (m memoryAPIKeyModel) Insert(ctx context.Context, key *APIKey) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	defer m.store.lock(m.inTx, memoryAPIKeys)()
+
+	m.store.nextAPIKeyID++
+
+	key.ID = m.store.nextAPIKeyID
+	key.CreatedAt = memoryNow()
+
+	stored := cloneAPIKey(key)
+	stored.Plaintext = ""
+
+	if key.Expiry != nil {
+		expiry := key.Expiry.Round(time.Second)
+		stored.Expiry = &expiry
+	}
+
+	m.store.apiKeys[string(key.Hash)] = stored
+
+	return nil
+}
+
+func (m memoryAPIKeyModel) GetByPlaintext(ctx context.Context, keyPlaintext string) (*APIKey, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	keyHash := sha256.Sum256([]byte(keyPlaintext))
+
+	defer m.store.rlock(m.inTx)()
+
+	key, ok := m.store.apiKeys[string(keyHash[:])]
+	if !ok || (key.Expiry != nil && !key.Expiry.After(time.Now())) {
+		return nil, ErrRecordNotFound
+	}
+
+	return cloneAPIKey(key), nil
+}
+
+func (m memoryAPIKeyModel) GetAllForUser(ctx context.Context, userID int64) ([]*APIKey, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	defer m.store.rlock(m.inTx)()
+
+	keys := []*APIKey{}
+
+	for _, key := range m.store.apiKeys {
+		if key.UserID == userID {
+			keys = append(keys, cloneAPIKey(key))
+		}
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		if !keys[i].CreatedAt.Equal(keys[j].CreatedAt) {
+			return keys[i].CreatedAt.After(keys[j].CreatedAt)
+		}
+		return keys[i].ID > keys[j].ID
+	})
+
+	return keys, nil
+}
+
+func (m memoryAPIKeyModel) Delete(ctx context.Context, userID, id int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	defer m.store.lock(m.inTx, memoryAPIKeys)()
+
+	for hash, key := range m.store.apiKeys {
+		if key.ID == id && key.UserID == userID {
+			delete(m.store.apiKeys, hash)
+			return nil
+		}
+	}
+
+	return ErrRecordNotFound
+}
+
+func (m memoryAPIKeyModel) DeleteAllForUser(ctx context.Context, userID int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	defer m.store.lock(m.inTx, memoryAPIKeys)()
+
+	for hash, key := range m.store.apiKeys {
+		if key.UserID == userID {
+			delete(m.store.apiKeys, hash)
+		}
+	}
+
+	return nil
+}
+
+type memoryAuditModel struct {
+	store *memoryStore
+	inTx  bool
+}
+
+func (m memoryAuditModel) Insert(ctx context.Context, entry *AuditEntry) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	defer m.store.lock(m.inTx, memoryAudit)()
+
+	entry.ID = int64(len(m.store.audit)) + 1
+	entry.CreatedAt = memoryNow()
+
+	m.store.audit = append(m.store.audit, *entry)
+
+	return nil
+}
+
+func (m memoryAuditModel) GetAllForUser(ctx context.Context, userID int64) ([]*AuditEntry, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	defer m.store.rlock(m.inTx)()
+
+	entries := []*AuditEntry{}
+
+	for _, entry := range m.store.audit {
+		if entry.UserID == userID {
+			found := entry
+			entries = append(entries, &found)
+		}
+	}
+
+	return entries, nil
+}
+
+type memoryDenylistModel struct {
+	store *memoryStore
+	inTx  bool
+}
+
+func (m memoryDenylistModel) Add(ctx context.Context, key string, expiry time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	defer m.store.lock(m.inTx, memoryDenylist)()
+
+	if expiry.After(m.store.denylist[key]) {
+		m.store.denylist[key] = expiry.Round(time.Second)
+	}
+
+	return nil
+}
+
+func (m memoryDenylistModel) Contains(ctx context.Context, key string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	defer m.store.rlock(m.inTx)()
+
+	expiry, ok := m.store.denylist[key]
+	return ok && expiry.After(time.Now()), nil
+}
+
+func (m memoryDenylistModel) DeleteExpired(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	defer m.store.lock(m.inTx, memoryDenylist)()
+
+	now := time.Now()
+
+	for key, expiry := range m.store.denylist {
+		if !expiry.After(now) {
+			delete(m.store.denylist, key)
+		}
+	}
+
+	return nil
+}
+
+type memoryIdentityModel struct {
+	store *memoryStore
+	inTx  bool
+}
+
+func (m memoryIdentityModel) Insert(ctx context.Context, identity *Identity) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	defer m.store.lock(m.inTx, memoryIdentities)()
+
+	k := memoryIdentityKey{identity.Issuer, identity.Subject}
+	if _, ok := m.store.identities[k]; ok {
+		return &ConstraintError{Kind: ErrUniqueViolation, Constraint: "user_identities_pkey", Table: "user_identities"}
+	}
+
+	identity.CreatedAt = memoryNow()
+
+	stored := *identity
+	m.store.identities[k] = &stored
+
+	return nil
+}
+
+func (m memoryIdentityModel) Get(ctx context.Context, issuer, subject string) (*Identity, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	defer m.store.rlock(m.inTx)()
+
+	identity, ok := m.store.identities[memoryIdentityKey{issuer, subject}]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+
+	found := *identity
+	return &found, nil
+}
+
+func (m memoryIdentityModel) GetAllForUser(ctx context.Context, userID int64) ([]*Identity, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	defer m.store.rlock(m.inTx)()
+
+	identities := []*Identity{}
+
+	for _, identity := range m.store.identities {
+		if identity.UserID == userID {
+			found := *identity
+			identities = append(identities, &found)
+		}
+	}
+
+	sort.Slice(identities, func(i, j int) bool {
+		return identities[i].CreatedAt.Before(identities[j].CreatedAt)
+	})
+
+	return identities, nil
+}
+
+type memoryOIDCLoginModel struct {
+	store *memoryStore
+	inTx  bool
+}
+
+func (m memoryOIDCLoginModel) Insert(ctx context.Context, login *OIDCLogin) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	defer m.store.lock(m.inTx, memoryOIDCLogins)()
+
+	stored := *login
+	stored.Expiry = login.Expiry.Round(time.Second)
+
+	m.store.oidcLogins[login.State] = &stored
+
+	return nil
+}
+
+func (m memoryOIDCLoginModel) Take(ctx context.Context, state string, secretHash []byte) (*OIDCLogin, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	defer m.store.lock(m.inTx, memoryOIDCLogins)()
+
+	login, ok := m.store.oidcLogins[state]
+	if !ok || !bytes.Equal(login.SecretHash, secretHash) {
+		return nil, ErrRecordNotFound
+	}
+
+	delete(m.store.oidcLogins, state)
+
+	if !login.Expiry.After(time.Now()) {
+		return nil, ErrRecordNotFound
+	}
+
+	found := *login
+	return &found, nil
+}
+
+func (m memoryOIDCLoginModel) DeleteExpired(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	defer m.store.lock(m.inTx, memoryOIDCLogins)()
+
+	now := time.Now()
+
+	for state, login := range m.store.oidcLogins {
+		if !login.Expiry.After(now) {
+			delete(m.store.oidcLogins, state)
+		}
+	}
+
+	return nil
+}
@@ -1,8 +1,10 @@
 package data
 
 import (
+	"context"
 	"database/sql"
 	"errors"
+	"time"
 )
 
 var (
@@ -10,18 +12,174 @@ var (
 	ErrEditConflict   = errors.New("edit conflict")
 )
 
+// DefaultQueryTimeout is the deadline applied to each model operation when
+// no timeout has been configured.
+const DefaultQueryTimeout = 3 * time.Second
+
+type MovieStore interface {
+	Insert(ctx context.Context, movie *Movie) error
+	// InsertMany adds movies in bulk, filling them in as Insert does. Run
+	// it in WithTx for all of them to be added or none.
+	InsertMany(ctx context.Context, movies []*Movie) error
+	Get(ctx context.Context, id int64) (*Movie, error)
+	Update(ctx context.Context, movie *Movie) error
+	Delete(ctx context.Context, id int64) error
+	GetAll(ctx context.Context, title string, genres []string, filters Filters) ([]*Movie, Metadata, error)
+	GetUpcoming(ctx context.Context, country string, filters Filters) ([]*Movie, Metadata, error)
+	GetAllForOwner(ctx context.Context, userID int64, filters Filters) ([]*Movie, Metadata, error)
+}
+
+type MovieChangeStore interface {
+	Since(ctx context.Context, token ChangeToken, limit int) ([]*MovieChange, ChangeToken, bool, error)
+}
+
+type UserStore interface {
+	Insert(ctx context.Context, user *User) error
+	Get(ctx context.Context, id int64) (*User, error)
+	GetByEmail(ctx context.Context, email string) (*User, error)
+	Update(ctx context.Context, user *User) error
+	GetForToken(ctx context.Context, tokenScope, tokenPlaintext string) (*User, error)
+	// PurgeDeleted deletes the users whose deletion was requested at or
+	// before before and returns their IDs. Run it in WithTx.
+	PurgeDeleted(ctx context.Context, before time.Time) ([]int64, error)
+}
+
+type TokenStore interface {
+	New(ctx context.Context, userID int64, ttl time.Duration, scope string) (*Token, error)
+	Insert(ctx context.Context, token *Token) error
+	GetByPlaintext(ctx context.Context, scope, tokenPlaintext string) (*Token, error)
+	Touch(ctx context.Context, tokenPlaintext, ip, userAgent string, notBefore time.Time) error
+	MarkRotated(ctx context.Context, id int64) error
+	Delete(ctx context.Context, scope string, userID int64, tokenPlaintext string) error
+	DeleteByID(ctx context.Context, scope string, userID, id int64) error
+	DeleteFamily(ctx context.Context, userID int64, family string) error
+	DeleteAllForUser(ctx context.Context, scope string, userID int64) error
+	GetAllForUser(ctx context.Context, userID int64) ([]*Token, error)
+}
+
+type PermissionStore interface {
+	GetAllForUser(ctx context.Context, userID int64) (Permissions, error)
+	AddForUser(ctx context.Context, userID int64, codes ...string) error
+}
+
+type APIKeyStore interface {
+	Insert(ctx context.Context, key *APIKey) error
+	GetByPlaintext(ctx context.Context, keyPlaintext string) (*APIKey, error)
+	GetAllForUser(ctx context.Context, userID int64) ([]*APIKey, error)
+	Delete(ctx context.Context, userID, id int64) error
+	DeleteAllForUser(ctx context.Context, userID int64) error
+}
+
+type AuditStore interface {
+	Insert(ctx context.Context, entry *AuditEntry) error
+	GetAllForUser(ctx context.Context, userID int64) ([]*AuditEntry, error)
+}
+
+type DenylistStore interface {
+	Add(ctx context.Context, key string, expiry time.Time) error
+	Contains(ctx context.Context, key string) (bool, error)
+	DeleteExpired(ctx context.Context) error
+}
+
+type IdentityStore interface {
+	Insert(ctx context.Context, identity *Identity) error
+	Get(ctx context.Context, issuer, subject string) (*Identity, error)
+	GetAllForUser(ctx context.Context, userID int64) ([]*Identity, error)
+}
+
+type OIDCLoginStore interface {
+	Insert(ctx context.Context, login *OIDCLogin) error
+	Take(ctx context.Context, state string, secretHash []byte) (*OIDCLogin, error)
+	DeleteExpired(ctx context.Context) error
+}
+
+type IdempotencyStore interface {
+	Begin(ctx context.Context, userID int64, key string, fingerprint []byte, ttl time.Duration) (*IdempotentResponse, error)
+	Complete(ctx context.Context, userID int64, key string, response *IdempotentResponse) error
+	Release(ctx context.Context, userID int64, key string) error
+	DeleteExpired(ctx context.Context) error
+}
+
 type Models struct {
-	Movies      MovieModel
-	Permissions PermissionModel
-	Tokens      TokenModel
-	Users       UserModel
+	APIKeys      APIKeyStore
+	Audit        AuditStore
+	Denylist     DenylistStore
+	Idempotency  IdempotencyStore
+	Identities   IdentityStore
+	Movies       MovieStore
+	MovieChanges MovieChangeStore
+	OIDCLogins   OIDCLoginStore
+	Permissions  PermissionStore
+	Tokens       TokenStore
+	Users        UserStore
+
+	transact func(ctx context.Context, fn func(Models) error) error
+}
+
+// NewModels returns models for Postgres. Read-only movie and permission
+// queries go to replicas when any are given; everything else, including all
+// work done in a transaction, runs on db.
+func NewModels(db *sql.DB, replicas *ReplicaSet, config QueryConfig) Models {
+	if replicas != nil {
+		for _, pool := range replicas.pools {
+			pool.handle = instrument(pool.DB, "postgresql", pool.Name, config)
+		}
+	}
+
+	models := postgresModels(instrument(db, "postgresql", "primary", config), replicas, config.Timeout)
+
+	models.transact = func(ctx context.Context, fn func(Models) error) error {
+		opts := &sql.TxOptions{Isolation: sql.LevelSerializable}
+
+		return runTx(ctx, db, opts, mapPostgresError, func(tx *txConn) error {
+			models := postgresModels(instrument(tx, "postgresql", "primary", config), nil, config.Timeout)
+			models.transact = joinTx(models)
+
+			return fn(models)
+		})
+	}
+
+	return models
 }
 
-func NewModels(db *sql.DB) Models {
+func postgresModels(db DBTX, replicas *ReplicaSet, queryTimeout time.Duration) Models {
 	return Models{
-		Movies:      MovieModel{DB: db},
-		Permissions: PermissionModel{DB: db},
-		Tokens:      TokenModel{DB: db},
-		Users:       UserModel{DB: db},
+		APIKeys:      APIKeyModel{DB: db, Timeout: queryTimeout},
+		Audit:        AuditModel{DB: db, Timeout: queryTimeout},
+		Denylist:     DenylistModel{DB: db, Timeout: queryTimeout},
+		Idempotency:  IdempotencyModel{DB: db, Timeout: queryTimeout},
+		Identities:   IdentityModel{DB: db, Timeout: queryTimeout},
+		Movies:       MovieModel{DB: db, Replicas: replicas, Timeout: queryTimeout},
+		MovieChanges: MovieChangeModel{DB: db, Timeout: queryTimeout},
+		OIDCLogins:   OIDCLoginModel{DB: db, Timeout: queryTimeout},
+		Permissions:  PermissionModel{DB: db, Replicas: replicas, Timeout: queryTimeout},
+		Tokens:       TokenModel{DB: db, Timeout: queryTimeout},
+		Users:        UserModel{DB: db, Timeout: queryTimeout},
 	}
 }
+
+type operationContextKey struct{}
+
+// withOperation bounds a single operation and names its statements after it,
+// such as MovieModel.GetAll, in spans, metrics and the slow-query log. The
+// deadline is derived from the caller's context, so a cancelled request also
+// cancels its queries.
+func withOperation(ctx context.Context, operation string, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		timeout = DefaultQueryTimeout
+	}
+
+	ctx = context.WithValue(ctx, operationContextKey{}, operation)
+
+	return context.WithTimeout(ctx, timeout)
+}
+
+// operationName returns the operation ctx was started for by withOperation.
+func operationName(ctx context.Context) string {
+	operation, ok := ctx.Value(operationContextKey{}).(string)
+	if !ok {
+		return "unnamed"
+	}
+
+	return operation
+}
@@ -8,17 +8,27 @@ import (
 	"fmt"
 	"time"
 
-	"github.com/lib/pq"
+	"github.com/jackc/pgx/v5"
 )
 
 type Movie struct {
-	ID        int64     `json:"id"`
-	CreatedAt time.Time `json:"-"`
-	Title     string    `json:"title"`
-	Year      int32     `json:"year,omitempty"`
-	Runtime   Runtime   `json:"runtime,omitempty"`
-	Genres    []string  `json:"genres,omitempty"`
-	Version   int32     `json:"version"`
+	ID           int64        `json:"id"`
+	CreatedAt    time.Time    `json:"created_at"`
+	UpdatedAt    time.Time    `json:"updated_at"`
+	Title        string       `json:"title"`
+	Year         int32        `json:"year,omitempty"`
+	Runtime      Runtime      `json:"runtime,omitempty"`
+	Genres       []string     `json:"genres,omitempty"`
+	Status       string       `json:"status"`
+	ReleaseDates ReleaseDates `json:"release_dates,omitempty"`
+	CreatedBy    *int64       `json:"created_by"`
+	Version      int32        `json:"version"`
+}
+
+// OwnedBy reports whether the movie was created by the given user. Movies
+// created before ownership was tracked have no owner.
+func (m *Movie) OwnedBy(userID int64) bool {
+	return m.CreatedBy != nil && *m.CreatedBy == userID
 }
 
 func ValidateMovie(v *validator.Validator, movie *Movie) {
@@ -27,7 +37,9 @@ func ValidateMovie(v *validator.Validator, movie *Movie) {
 
 	v.Check(movie.Year != 0, "year", "must be provided")
 	v.Check(movie.Year >= 1888, "year", "must be greater than 1888")
-	v.Check(movie.Year <= int32(time.Now().Year()), "year", "must not be in the future")
+
+	v.Check(validator.PermittedValue(movie.Status, ReleaseStatuses...), "status", "must be one of announced, in_production, released or cancelled")
+	validateYearForStatus(v, movie.Year, movie.Status)
 
 	v.Check(movie.Runtime != 0, "runtime", "must be provided")
 	v.Check(movie.Runtime > 0, "runtime", "must be a positive integer")
@@ -36,48 +48,126 @@ func ValidateMovie(v *validator.Validator, movie *Movie) {
 	v.Check(len(movie.Genres) >= 1, "genres", "must contain at least 1 genre")
 	v.Check(len(movie.Genres) <= 5, "genres", "must not contain more than 5 genres")
 	v.Check(validator.Unique(movie.Genres), "genres", "must not contain duplicate values")
+
+	ValidateReleaseDates(v, movie.ReleaseDates)
 }
 
 type MovieModel struct {
-	DB *sql.DB
+	DB       DBTX
+	Replicas *ReplicaSet
+	Timeout  time.Duration
 }
 
-func (m MovieModel) Insert(movie *Movie) error {
+func (m MovieModel) Insert(ctx context.Context, movie *Movie) error {
 	query := `
-        INSERT INTO movies (title, year, runtime, genres) 
-        VALUES ($1, $2, $3, $4)
-        RETURNING id, created_at, version`
+        WITH inserted AS (
+            INSERT INTO movies (title, year, runtime, genres, status, release_dates, created_by) 
+            VALUES ($1, $2, $3, $4, $5, $6, $7)
+            RETURNING id, created_at, updated_at, version
+        ), logged AS (
+            INSERT INTO movie_changes (movie_id, operation)
+            SELECT id, 'created' FROM inserted
+        )
+        SELECT id, created_at, updated_at, version FROM inserted`
+
+	args := []any{movie.Title, movie.Year, movie.Runtime, movie.Genres, movie.Status, movie.ReleaseDates, movie.CreatedBy}
+
+	ctx, cancel := withOperation(ctx, "MovieModel.Insert", m.Timeout)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&movie.ID, &movie.CreatedAt, &movie.UpdatedAt, &movie.Version)
+}
 
-	args := []any{movie.Title, movie.Year, movie.Runtime, pq.Array(movie.Genres)}
+// InsertMany streams movies in with COPY FROM. Their IDs are drawn from the
+// sequence first, so that their change log entries can be written in the
+// same transaction.
+func (m MovieModel) InsertMany(ctx context.Context, movies []*Movie) error {
+	if len(movies) == 0 {
+		return nil
+	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := withOperation(ctx, "MovieModel.InsertMany", m.Timeout)
 	defer cancel()
 
-	return m.DB.QueryRowContext(ctx, query, args...).Scan(&movie.ID, &movie.CreatedAt, &movie.Version)
+	return m.DB.Raw(ctx, "COPY movies FROM STDIN", func(ctx context.Context, conn *pgx.Conn) (int, error) {
+		rows, _ := conn.Query(ctx, `
+            SELECT nextval(pg_get_serial_sequence('movies', 'id'))
+            FROM generate_series(1, $1)`, len(movies))
+
+		ids, err := pgx.CollectRows(rows, pgx.RowTo[int64])
+		if err != nil {
+			return 0, err
+		}
+
+		columns := []string{"id", "title", "year", "runtime", "genres", "status", "release_dates", "created_by"}
+
+		copied, err := conn.CopyFrom(ctx, pgx.Identifier{"movies"}, columns, pgx.CopyFromSlice(len(movies), func(i int) ([]any, error) {
+			movie := movies[i]
+			return []any{ids[i], movie.Title, movie.Year, movie.Runtime, movie.Genres, movie.Status, movie.ReleaseDates, movie.CreatedBy}, nil
+		}))
+		if err != nil {
+			return 0, err
+		}
+
+		_, err = conn.Exec(ctx, `
+            INSERT INTO movie_changes (movie_id, operation)
+            SELECT unnest($1::bigint[]), 'created'`, ids)
+		if err != nil {
+			return 0, err
+		}
+
+		rows, _ = conn.Query(ctx, `
+            SELECT id, created_at, updated_at, version
+            FROM movies
+            WHERE id = ANY($1)`, ids)
+
+		inserted := make(map[int64]*Movie, len(movies))
+		for i, movie := range movies {
+			movie.ID = ids[i]
+			inserted[movie.ID] = movie
+		}
+
+		var movie Movie
+
+		_, err = pgx.ForEachRow(rows, []any{&movie.ID, &movie.CreatedAt, &movie.UpdatedAt, &movie.Version}, func() error {
+			target := inserted[movie.ID]
+			target.CreatedAt, target.UpdatedAt, target.Version = movie.CreatedAt, movie.UpdatedAt, movie.Version
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+
+		return int(copied), nil
+	})
 }
 
-func (m MovieModel) Get(id int64) (*Movie, error) {
+func (m MovieModel) Get(ctx context.Context, id int64) (*Movie, error) {
 	if id < 1 {
 		return nil, ErrRecordNotFound
 	}
 
 	query := `
-        SELECT id, created_at, title, year, runtime, genres, version
+        SELECT id, created_at, updated_at, title, year, runtime, genres, status, release_dates, created_by, version
         FROM movies
         WHERE id = $1`
 
 	var movie Movie
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := withOperation(ctx, "MovieModel.Get", m.Timeout)
 	defer cancel()
 
-	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+	err := m.Replicas.reader(ctx, m.DB).QueryRowContext(ctx, query, id).Scan(
 		&movie.ID,
 		&movie.CreatedAt,
+		&movie.UpdatedAt,
 		&movie.Title,
 		&movie.Year,
 		&movie.Runtime,
-		pq.Array(&movie.Genres),
+		pgArray(&movie.Genres),
+		&movie.Status,
+		&movie.ReleaseDates,
+		&movie.CreatedBy,
 		&movie.Version,
 	)
 	if err != nil {
@@ -92,26 +182,34 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
 	return &movie, nil
 }
 
-func (m MovieModel) Update(movie *Movie) error {
+func (m MovieModel) Update(ctx context.Context, movie *Movie) error {
 	query := `
-        UPDATE movies 
-        SET title = $1, year = $2, runtime = $3, genres = $4, version = version + 1
-        WHERE id = $5 AND version = $6
-        RETURNING version`
+        WITH updated AS (
+            UPDATE movies 
+            SET title = $1, year = $2, runtime = $3, genres = $4, status = $5, release_dates = $6, updated_at = NOW(), version = version + 1
+            WHERE id = $7 AND version = $8
+            RETURNING id, updated_at, version
+        ), logged AS (
+            INSERT INTO movie_changes (movie_id, operation)
+            SELECT id, 'updated' FROM updated
+        )
+        SELECT updated_at, version FROM updated`
 
 	args := []any{
 		movie.Title,
 		movie.Year,
 		movie.Runtime,
-		pq.Array(movie.Genres),
+		movie.Genres,
+		movie.Status,
+		movie.ReleaseDates,
 		movie.ID,
 		movie.Version,
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := withOperation(ctx, "MovieModel.Update", m.Timeout)
 	defer cancel()
 
-	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&movie.Version)
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&movie.UpdatedAt, &movie.Version)
 	if err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
@@ -124,24 +222,28 @@ func (m MovieModel) Update(movie *Movie) error {
 	return nil
 }
 
-func (m MovieModel) Delete(id int64) error {
+func (m MovieModel) Delete(ctx context.Context, id int64) error {
 	if id < 1 {
 		return ErrRecordNotFound
 	}
 
 	query := `
-        DELETE FROM movies
-        WHERE id = $1`
-
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+        WITH deleted AS (
+            DELETE FROM movies
+            WHERE id = $1
+            RETURNING id
+        ), logged AS (
+            INSERT INTO movie_changes (movie_id, operation)
+            SELECT id, 'deleted' FROM deleted
+        )
+        SELECT count(*) FROM deleted`
+
+	ctx, cancel := withOperation(ctx, "MovieModel.Delete", m.Timeout)
 	defer cancel()
 
-	result, err := m.DB.ExecContext(ctx, query, id)
-	if err != nil {
-		return err
-	}
+	var rowsAffected int64
 
-	rowsAffected, err := result.RowsAffected()
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(&rowsAffected)
 	if err != nil {
 		return err
 	}
@@ -153,21 +255,134 @@ func (m MovieModel) Delete(id int64) error {
 	return nil
 }
 
-func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*Movie, Metadata, error) {
+func (m MovieModel) GetAll(ctx context.Context, title string, genres []string, filters Filters) ([]*Movie, Metadata, error) {
 	query := fmt.Sprintf(`
-        SELECT count(*) OVER(), id, created_at, title, year, runtime, genres, version
+        SELECT count(*) OVER(), id, created_at, updated_at, title, year, runtime, genres, status, release_dates, created_by, version
         FROM movies
         WHERE (to_tsvector('simple', title) @@ plainto_tsquery('simple', $1) OR $1 = '') 
         AND (genres @> $2 OR $2 = '{}')     
         ORDER BY %s %s, id ASC
         LIMIT $3 OFFSET $4`, filters.sortColumn(), filters.sortDirection())
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := withOperation(ctx, "MovieModel.GetAll", m.Timeout)
+	defer cancel()
+
+	args := []any{title, genres, filters.limit(), filters.offset()}
+
+	rows, err := m.Replicas.reader(ctx, m.DB).QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	defer rows.Close()
+
+	totalRecords := 0
+	movies := []*Movie{}
+
+	for rows.Next() {
+		var movie Movie
+
+		err := rows.Scan(
+			&totalRecords,
+			&movie.ID,
+			&movie.CreatedAt,
+			&movie.UpdatedAt,
+			&movie.Title,
+			&movie.Year,
+			&movie.Runtime,
+			pgArray(&movie.Genres),
+			&movie.Status,
+			&movie.ReleaseDates,
+			&movie.CreatedBy,
+			&movie.Version,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		movies = append(movies, &movie)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return movies, metadata, nil
+}
+
+func (m MovieModel) GetUpcoming(ctx context.Context, country string, filters Filters) ([]*Movie, Metadata, error) {
+	query := fmt.Sprintf(`
+        SELECT count(*) OVER(), id, created_at, updated_at, title, year, runtime, genres, status, release_dates, created_by, version
+        FROM movies
+        WHERE status = ANY($1)
+        AND (release_dates ? $2 OR $2 = '')
+        ORDER BY %s %s, id ASC
+        LIMIT $3 OFFSET $4`, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := withOperation(ctx, "MovieModel.GetUpcoming", m.Timeout)
+	defer cancel()
+
+	args := []any{UpcomingStatuses, country, filters.limit(), filters.offset()}
+
+	rows, err := m.Replicas.reader(ctx, m.DB).QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	defer rows.Close()
+
+	totalRecords := 0
+	movies := []*Movie{}
+
+	for rows.Next() {
+		var movie Movie
+
+		err := rows.Scan(
+			&totalRecords,
+			&movie.ID,
+			&movie.CreatedAt,
+			&movie.UpdatedAt,
+			&movie.Title,
+			&movie.Year,
+			&movie.Runtime,
+			pgArray(&movie.Genres),
+			&movie.Status,
+			&movie.ReleaseDates,
+			&movie.CreatedBy,
+			&movie.Version,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		movies = append(movies, &movie)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return movies, metadata, nil
+}
+
+func (m MovieModel) GetAllForOwner(ctx context.Context, userID int64, filters Filters) ([]*Movie, Metadata, error) {
+	query := fmt.Sprintf(`
+        SELECT count(*) OVER(), id, created_at, updated_at, title, year, runtime, genres, status, release_dates, created_by, version
+        FROM movies
+        WHERE created_by = $1
+        ORDER BY %s %s, id ASC
+        LIMIT $2 OFFSET $3`, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := withOperation(ctx, "MovieModel.GetAllForOwner", m.Timeout)
 	defer cancel()
 
-	args := []any{title, pq.Array(genres), filters.limit(), filters.offset()}
+	args := []any{userID, filters.limit(), filters.offset()}
 
-	rows, err := m.DB.QueryContext(ctx, query, args...)
+	rows, err := m.Replicas.reader(ctx, m.DB).QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, Metadata{}, err
 	}
@@ -184,10 +399,14 @@ func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*M
 			&totalRecords,
 			&movie.ID,
 			&movie.CreatedAt,
+			&movie.UpdatedAt,
 			&movie.Title,
 			&movie.Year,
 			&movie.Runtime,
-			pq.Array(&movie.Genres),
+			pgArray(&movie.Genres),
+			&movie.Status,
+			&movie.ReleaseDates,
+			&movie.CreatedBy,
 			&movie.Version,
 		)
 		if err != nil {
@@ -0,0 +1,169 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// Identity links a user to their account at an OpenID Connect provider,
+// which is identified by its issuer and knows the user by subject.
+type Identity struct {
+	Issuer    string    `json:"issuer"`
+	Subject   string    `json:"subject"`
+	UserID    int64     `json:"-"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// OIDCLogin is a login started with an OpenID Connect provider and not yet
+// completed. It is keyed by the state sent to the provider, and bound to the
+// client that started it by the hash of a secret only that client was given.
+type OIDCLogin struct {
+	State      string
+	Nonce      string
+	Verifier   string
+	SecretHash []byte
+	Expiry     time.Time
+}
+
+type IdentityModel struct {
+	DB      DBTX
+	Timeout time.Duration
+}
+
+func (m IdentityModel) Insert(ctx context.Context, identity *Identity) error {
+	query := `
+        INSERT INTO user_identities (issuer, subject, user_id)
+        VALUES ($1, $2, $3)
+        RETURNING created_at`
+
+	ctx, cancel := withOperation(ctx, "IdentityModel.Insert", m.Timeout)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, identity.Issuer, identity.Subject, identity.UserID).Scan(&identity.CreatedAt)
+}
+
+func (m IdentityModel) Get(ctx context.Context, issuer, subject string) (*Identity, error) {
+	query := `
+        SELECT issuer, subject, user_id, created_at
+        FROM user_identities
+        WHERE issuer = $1 AND subject = $2`
+
+	ctx, cancel := withOperation(ctx, "IdentityModel.Get", m.Timeout)
+	defer cancel()
+
+	var identity Identity
+
+	err := m.DB.QueryRowContext(ctx, query, issuer, subject).Scan(&identity.Issuer, &identity.Subject, &identity.UserID, &identity.CreatedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &identity, nil
+}
+
+func (m IdentityModel) GetAllForUser(ctx context.Context, userID int64) ([]*Identity, error) {
+	query := `
+        SELECT issuer, subject, user_id, created_at
+        FROM user_identities
+        WHERE user_id = $1
+        ORDER BY created_at`
+
+	ctx, cancel := withOperation(ctx, "IdentityModel.GetAllForUser", m.Timeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanIdentities(rows)
+}
+
+func scanIdentities(rows *Rows) ([]*Identity, error) {
+	identities := []*Identity{}
+
+	for rows.Next() {
+		var identity Identity
+
+		err := rows.Scan(&identity.Issuer, &identity.Subject, &identity.UserID, &identity.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		identities = append(identities, &identity)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return identities, nil
+}
+
+type OIDCLoginModel struct {
+	DB      DBTX
+	Timeout time.Duration
+}
+
+func (m OIDCLoginModel) Insert(ctx context.Context, login *OIDCLogin) error {
+	query := `
+        INSERT INTO oidc_logins (state, nonce, verifier, secret_hash, expiry)
+        VALUES ($1, $2, $3, $4, $5)`
+
+	ctx, cancel := withOperation(ctx, "OIDCLoginModel.Insert", m.Timeout)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, login.State, login.Nonce, login.Verifier, login.SecretHash, login.Expiry)
+	return err
+}
+
+// Take deletes and returns the login started with state, so that it can only
+// be completed once. It returns ErrRecordNotFound if there is none, it has
+// expired or its secret does not hash to secretHash; in the last case the
+// login is left for its client to complete.
+func (m OIDCLoginModel) Take(ctx context.Context, state string, secretHash []byte) (*OIDCLogin, error) {
+	query := `
+        DELETE FROM oidc_logins
+        WHERE state = $1 AND secret_hash = $2
+        RETURNING state, nonce, verifier, secret_hash, expiry`
+
+	ctx, cancel := withOperation(ctx, "OIDCLoginModel.Take", m.Timeout)
+	defer cancel()
+
+	var login OIDCLogin
+
+	err := m.DB.QueryRowContext(ctx, query, state, secretHash).Scan(&login.State, &login.Nonce, &login.Verifier, &login.SecretHash, &login.Expiry)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	if !login.Expiry.After(time.Now()) {
+		return nil, ErrRecordNotFound
+	}
+
+	return &login, nil
+}
+
+func (m OIDCLoginModel) DeleteExpired(ctx context.Context) error {
+	query := `
+        DELETE FROM oidc_logins
+        WHERE expiry <= NOW()`
+
+	ctx, cancel := withOperation(ctx, "OIDCLoginModel.DeleteExpired", m.Timeout)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query)
+	return err
+}
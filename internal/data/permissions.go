@@ -2,10 +2,7 @@ package data
 
 import (
 	"context"
-	"database/sql"
 	"time"
-
-	"github.com/lib/pq"
 )
 
 type Permissions []string
@@ -20,10 +17,12 @@ func (p Permissions) Include(code string) bool {
 }
 
 type PermissionModel struct {
-	DB *sql.DB
+	DB       DBTX
+	Replicas *ReplicaSet
+	Timeout  time.Duration
 }
 
-func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
+func (m PermissionModel) GetAllForUser(ctx context.Context, userID int64) (Permissions, error) {
 	query := `
         SELECT permissions.code
         FROM permissions
@@ -31,10 +30,10 @@ func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
         INNER JOIN users ON users_permissions.user_id = users.id
         WHERE users.id = $1`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := withOperation(ctx, "PermissionModel.GetAllForUser", m.Timeout)
 	defer cancel()
 
-	rows, err := m.DB.QueryContext(ctx, query, userID)
+	rows, err := m.Replicas.reader(ctx, m.DB).QueryContext(ctx, query, userID)
 	if err != nil {
 		return nil, err
 	}
@@ -59,14 +58,14 @@ func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
 	return permissions, nil
 }
 
-func (m PermissionModel) AddForUser(userID int64, codes ...string) error {
+func (m PermissionModel) AddForUser(ctx context.Context, userID int64, codes ...string) error {
 	query := `
         INSERT INTO users_permissions
         SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := withOperation(ctx, "PermissionModel.AddForUser", m.Timeout)
 	defer cancel()
 
-	_, err := m.DB.ExecContext(ctx, query, userID, pq.Array(codes))
+	_, err := m.DB.ExecContext(ctx, query, userID, codes)
 	return err
 }
@@ -0,0 +1,33 @@
+package data
+
+import (
+	"database/sql"
+	"sync"
+
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// typeMaps holds pgtype maps for pgArray. A map caches scan plans and is not
+// safe for concurrent use, so each scan borrows one.
+var typeMaps = sync.Pool{
+	New: func() any { return pgtype.NewMap() },
+}
+
+// pgArray scans a Postgres array into dest, which must point to a slice. The
+// pgx database/sql driver returns arrays in their text form and leaves
+// decoding them to the caller. Arrays are passed as arguments as plain
+// slices.
+func pgArray(dest any) sql.Scanner {
+	return arrayScanner{dest: dest}
+}
+
+type arrayScanner struct {
+	dest any
+}
+
+func (s arrayScanner) Scan(src any) error {
+	m := typeMaps.Get().(*pgtype.Map)
+	defer typeMaps.Put(m)
+
+	return m.SQLScanner(s.dest).Scan(src)
+}
@@ -0,0 +1,103 @@
+package data
+
+import (
+	"autherain/golang_arxiv/internal/validator"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"regexp"
+	"time"
+)
+
+const (
+	StatusAnnounced    = "announced"
+	StatusInProduction = "in_production"
+	StatusReleased     = "released"
+	StatusCancelled    = "cancelled"
+)
+
+var ReleaseStatuses = []string{StatusAnnounced, StatusInProduction, StatusReleased, StatusCancelled}
+
+// UpcomingStatuses are the statuses of movies that have not come out yet.
+var UpcomingStatuses = []string{StatusAnnounced, StatusInProduction}
+
+// maxYearsAhead bounds how far in the future an unreleased movie can be dated.
+const maxYearsAhead = 10
+
+const releaseDateLayout = "2006-01-02"
+
+var countryCodeRX = regexp.MustCompile("^[A-Z]{2}$")
+
+// ReleaseDates maps an ISO 3166-1 alpha-2 country code to a release date
+// formatted as YYYY-MM-DD. It is stored as a jsonb column.
+type ReleaseDates map[string]string
+
+func (rd ReleaseDates) Value() (driver.Value, error) {
+	if rd == nil {
+		return "{}", nil
+	}
+
+	js, err := json.Marshal(map[string]string(rd))
+	if err != nil {
+		return nil, err
+	}
+
+	return string(js), nil
+}
+
+func (rd *ReleaseDates) Scan(src any) error {
+	var js []byte
+
+	switch v := src.(type) {
+	case []byte:
+		js = v
+	case string:
+		js = []byte(v)
+	case nil:
+		*rd = nil
+		return nil
+	default:
+		return errors.New("unsupported type for release dates")
+	}
+
+	var m map[string]string
+
+	err := json.Unmarshal(js, &m)
+	if err != nil {
+		return err
+	}
+
+	if len(m) == 0 {
+		m = nil
+	}
+
+	*rd = m
+
+	return nil
+}
+
+func ValidateReleaseDates(v *validator.Validator, rd ReleaseDates) {
+	v.Check(len(rd) <= 250, "release_dates", "must not contain more than 250 countries")
+
+	for country, date := range rd {
+		v.Check(validator.Matches(country, countryCodeRX), "release_dates", "must be keyed by ISO 3166-1 alpha-2 country codes")
+
+		_, err := time.Parse(releaseDateLayout, date)
+		v.Check(err == nil, "release_dates", "must contain dates in YYYY-MM-DD format")
+	}
+}
+
+func ValidateCountryCode(v *validator.Validator, key, country string) {
+	v.Check(validator.Matches(country, countryCodeRX), key, "must be an ISO 3166-1 alpha-2 country code")
+}
+
+func validateYearForStatus(v *validator.Validator, year int32, status string) {
+	currentYear := int32(time.Now().Year())
+
+	switch status {
+	case StatusReleased:
+		v.Check(year <= currentYear, "year", "must not be in the future")
+	default:
+		v.Check(year <= currentYear+maxYearsAhead, "year", "must not be more than 10 years in the future")
+	}
+}
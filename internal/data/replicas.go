@@ -0,0 +1,110 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"sync/atomic"
+	"time"
+)
+
+type primaryContextKey struct{}
+
+// WithPrimary returns a context whose reads are sent to the primary, for
+// callers that must see writes the replicas may not have replayed yet.
+func WithPrimary(ctx context.Context) context.Context {
+	return context.WithValue(ctx, primaryContextKey{}, true)
+}
+
+func usePrimary(ctx context.Context) bool {
+	primary, _ := ctx.Value(primaryContextKey{}).(bool)
+	return primary
+}
+
+// Pool is a named connection pool along with the result of its last health
+// check. Pools start out healthy so that reads are spread before the first
+// check completes.
+type Pool struct {
+	Name string
+	DB   *sql.DB
+
+	// handle is the instrumented DB, set up when the pool is given to
+	// NewModels.
+	handle DBTX
+
+	healthy   atomic.Bool
+	lastError atomic.Pointer[string]
+}
+
+func NewPool(name string, db *sql.DB) *Pool {
+	pool := &Pool{Name: name, DB: db}
+	pool.healthy.Store(true)
+
+	return pool
+}
+
+// Check pings the pool and records whether it answered within timeout.
+func (p *Pool) Check(ctx context.Context, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	err := p.DB.PingContext(ctx)
+	if err != nil {
+		msg := err.Error()
+		p.lastError.Store(&msg)
+	} else {
+		p.lastError.Store(nil)
+	}
+
+	p.healthy.Store(err == nil)
+
+	return err
+}
+
+func (p *Pool) Healthy() bool {
+	return p.healthy.Load()
+}
+
+// LastError returns the error from the last failed health check, or "" when
+// the last check succeeded.
+func (p *Pool) LastError() string {
+	if msg := p.lastError.Load(); msg != nil {
+		return *msg
+	}
+
+	return ""
+}
+
+// ReplicaSet spreads reads over read-only replicas of the primary database,
+// skipping replicas that failed their last health check. A nil ReplicaSet
+// sends every read to the primary.
+type ReplicaSet struct {
+	pools []*Pool
+	next  atomic.Uint64
+}
+
+func NewReplicaSet(pools ...*Pool) *ReplicaSet {
+	if len(pools) == 0 {
+		return nil
+	}
+
+	return &ReplicaSet{pools: pools}
+}
+
+// reader returns the handle a read-only query should use: a healthy replica
+// chosen round-robin, or primary when ctx asks for it or none is available.
+func (s *ReplicaSet) reader(ctx context.Context, primary DBTX) DBTX {
+	if s == nil || usePrimary(ctx) {
+		return primary
+	}
+
+	start := s.next.Add(1)
+
+	for i := range s.pools {
+		pool := s.pools[(start+uint64(i))%uint64(len(s.pools))]
+		if pool.Healthy() && pool.handle != nil {
+			return pool.handle
+		}
+	}
+
+	return primary
+}
@@ -0,0 +1,1382 @@
+package data
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// NewSQLiteModels returns models for a database created from the migrations
+// in migrations/sqlite. Arrays are stored as JSON text, title search uses the
+// movies_fts FTS5 table and emails are compared with COLLATE NOCASE.
+func NewSQLiteModels(db *sql.DB, config QueryConfig) Models {
+	models := sqliteModels(instrument(db, "sqlite", "primary", config), config.Timeout)
+
+	models.transact = func(ctx context.Context, fn func(Models) error) error {
+		return runTx(ctx, db, nil, mapSQLiteError, func(tx *txConn) error {
+			models := sqliteModels(instrument(tx, "sqlite", "primary", config), config.Timeout)
+			models.transact = joinTx(models)
+
+			return fn(models)
+		})
+	}
+
+	return models
+}
+
+func sqliteModels(db DBTX, queryTimeout time.Duration) Models {
+	return Models{
+		APIKeys:      sqliteAPIKeyModel{DB: db, Timeout: queryTimeout},
+		Audit:        sqliteAuditModel{DB: db, Timeout: queryTimeout},
+		Denylist:     sqliteDenylistModel{DB: db, Timeout: queryTimeout},
+		Idempotency:  sqliteIdempotencyModel{DB: db, Timeout: queryTimeout},
+		Identities:   sqliteIdentityModel{DB: db, Timeout: queryTimeout},
+		Movies:       sqliteMovieModel{DB: db, Timeout: queryTimeout},
+		MovieChanges: sqliteMovieChangeModel{DB: db, Timeout: queryTimeout},
+		OIDCLogins:   sqliteOIDCLoginModel{DB: db, Timeout: queryTimeout},
+		Permissions:  sqlitePermissionModel{DB: db, Timeout: queryTimeout},
+		Tokens:       sqliteTokenModel{DB: db, Timeout: queryTimeout},
+		Users:        sqliteUserModel{DB: db, Timeout: queryTimeout},
+	}
+}
+
+// sqliteNow returns the current time in the form stored by the timestamp
+// columns: UTC with one-second precision, so that stored values compare
+// correctly as text.
+func sqliteNow() time.Time {
+	return time.Now().UTC().Round(time.Second)
+}
+
+// sqliteTime converts an optional time to the form sqliteNow returns.
+func sqliteTime(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+
+	converted := t.UTC().Round(time.Second)
+	return &converted
+}
+
+// sqliteArray stores a slice as a JSON array, standing in for Postgres
+// arrays. Pass a slice to write a value and a pointer to a slice to scan one.
+type sqliteArray struct {
+	v any
+}
+
+func (a sqliteArray) Value() (driver.Value, error) {
+	js, err := json.Marshal(a.v)
+	if err != nil {
+		return nil, err
+	}
+
+	if string(js) == "null" {
+		return "[]", nil
+	}
+
+	return string(js), nil
+}
+
+func (a sqliteArray) Scan(src any) error {
+	switch v := src.(type) {
+	case string:
+		return json.Unmarshal([]byte(v), a.v)
+	case []byte:
+		return json.Unmarshal(v, a.v)
+	case nil:
+		return nil
+	default:
+		return errors.New("unsupported type for array")
+	}
+}
+
+// sqliteArrayScanner scans a JSON array into dest, in the form scanAPIKey
+// takes.
+func sqliteArrayScanner(dest any) sql.Scanner {
+	return sqliteArray{dest}
+}
+
+// ftsQuery turns free text into an FTS5 query requiring every word, which is
+// what plainto_tsquery does for the Postgres model.
+func ftsQuery(title string) string {
+	words := textSearchWords(title)
+
+	for i := range words {
+		words[i] = `"` + words[i] + `"`
+	}
+
+	return strings.Join(words, " ")
+}
+
+type sqliteMovieModel struct {
+	DB      DBTX
+	Timeout time.Duration
+}
+
+func (m sqliteMovieModel) Insert(ctx context.Context, movie *Movie) error {
+	query := `
+        INSERT INTO movies (title, year, runtime, genres, status, release_dates, created_by, created_at, updated_at)
+        VALUES (?1, ?2, ?3, ?4, ?5, ?6, ?7, ?8, ?8)
+        RETURNING id, created_at, updated_at, version`
+
+	args := []any{movie.Title, movie.Year, movie.Runtime, sqliteArray{movie.Genres}, movie.Status, movie.ReleaseDates, movie.CreatedBy, sqliteNow()}
+
+	ctx, cancel := withOperation(ctx, "sqliteMovieModel.Insert", m.Timeout)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&movie.ID, &movie.CreatedAt, &movie.UpdatedAt, &movie.Version)
+}
+
+// InsertMany inserts the movies one at a time; SQLite has no bulk load and
+// does not guarantee the order of RETURNING rows.
+func (m sqliteMovieModel) InsertMany(ctx context.Context, movies []*Movie) error {
+	for _, movie := range movies {
+		err := m.Insert(ctx, movie)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m sqliteMovieModel) Get(ctx context.Context, id int64) (*Movie, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+        SELECT id, created_at, updated_at, title, year, runtime, genres, status, release_dates, created_by, version
+        FROM movies
+        WHERE id = ?`
+
+	var movie Movie
+
+	ctx, cancel := withOperation(ctx, "sqliteMovieModel.Get", m.Timeout)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&movie.ID,
+		&movie.CreatedAt,
+		&movie.UpdatedAt,
+		&movie.Title,
+		&movie.Year,
+		&movie.Runtime,
+		sqliteArray{&movie.Genres},
+		&movie.Status,
+		&movie.ReleaseDates,
+		&movie.CreatedBy,
+		&movie.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &movie, nil
+}
+
+func (m sqliteMovieModel) Update(ctx context.Context, movie *Movie) error {
+	query := `
+        UPDATE movies
+        SET title = ?, year = ?, runtime = ?, genres = ?, status = ?, release_dates = ?, updated_at = ?, version = version + 1
+        WHERE id = ? AND version = ?
+        RETURNING updated_at, version`
+
+	args := []any{
+		movie.Title,
+		movie.Year,
+		movie.Runtime,
+		sqliteArray{movie.Genres},
+		movie.Status,
+		movie.ReleaseDates,
+		sqliteNow(),
+		movie.ID,
+		movie.Version,
+	}
+
+	ctx, cancel := withOperation(ctx, "sqliteMovieModel.Update", m.Timeout)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&movie.UpdatedAt, &movie.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m sqliteMovieModel) Delete(ctx context.Context, id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := `
+        DELETE FROM movies
+        WHERE id = ?`
+
+	ctx, cancel := withOperation(ctx, "sqliteMovieModel.Delete", m.Timeout)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+func (m sqliteMovieModel) GetAll(ctx context.Context, title string, genres []string, filters Filters) ([]*Movie, Metadata, error) {
+	match := ftsQuery(title)
+	if title != "" && match == "" {
+		return []*Movie{}, Metadata{}, nil
+	}
+
+	where := `
+        (?1 = '' OR id IN (SELECT rowid FROM movies_fts WHERE movies_fts MATCH ?1))
+        AND NOT EXISTS (
+            SELECT 1 FROM json_each(?2) AS wanted
+            WHERE wanted.value NOT IN (SELECT value FROM json_each(movies.genres))
+        )`
+
+	return m.list(ctx, "sqliteMovieModel.GetAll", where, []any{match, sqliteArray{genres}}, filters)
+}
+
+func (m sqliteMovieModel) GetUpcoming(ctx context.Context, country string, filters Filters) ([]*Movie, Metadata, error) {
+	where := `
+        status IN (SELECT value FROM json_each(?1))
+        AND (?2 = '' OR EXISTS (SELECT 1 FROM json_each(movies.release_dates) WHERE key = ?2))`
+
+	return m.list(ctx, "sqliteMovieModel.GetUpcoming", where, []any{sqliteArray{UpcomingStatuses}, country}, filters)
+}
+
+func (m sqliteMovieModel) GetAllForOwner(ctx context.Context, userID int64, filters Filters) ([]*Movie, Metadata, error) {
+	return m.list(ctx, "sqliteMovieModel.GetAllForOwner", "created_by = ?1", []any{userID}, filters)
+}
+
+// list runs a paginated query over movies on behalf of operation. The where
+// clause may refer to its arguments as ?1, ?2, ...; the pagination arguments
+// are appended after them.
+func (m sqliteMovieModel) list(ctx context.Context, operation, where string, args []any, filters Filters) ([]*Movie, Metadata, error) {
+	query := fmt.Sprintf(`
+        SELECT count(*) OVER(), id, created_at, updated_at, title, year, runtime, genres, status, release_dates, created_by, version
+        FROM movies
+        WHERE %s
+        ORDER BY %s %s, id ASC
+        LIMIT ?%d OFFSET ?%d`, where, filters.sortColumn(), filters.sortDirection(), len(args)+1, len(args)+2)
+
+	ctx, cancel := withOperation(ctx, operation, m.Timeout)
+	defer cancel()
+
+	args = append(args, filters.limit(), filters.offset())
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	defer rows.Close()
+
+	totalRecords := 0
+	movies := []*Movie{}
+
+	for rows.Next() {
+		var movie Movie
+
+		err := rows.Scan(
+			&totalRecords,
+			&movie.ID,
+			&movie.CreatedAt,
+			&movie.UpdatedAt,
+			&movie.Title,
+			&movie.Year,
+			&movie.Runtime,
+			sqliteArray{&movie.Genres},
+			&movie.Status,
+			&movie.ReleaseDates,
+			&movie.CreatedBy,
+			&movie.Version,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		movies = append(movies, &movie)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return movies, metadata, nil
+}
+
+type sqliteMovieChangeModel struct {
+	DB      DBTX
+	Timeout time.Duration
+}
+
+// Since pages through movie_changes, which is filled by triggers. SQLite
+// allows a single writer at a time, so log ids are handed out in commit order
+// and the token only needs the id.
+func (m sqliteMovieChangeModel) Since(ctx context.Context, token ChangeToken, limit int) ([]*MovieChange, ChangeToken, bool, error) {
+	query := `
+        SELECT id, movie_id, operation, changed_at
+        FROM movie_changes
+        WHERE id > ?
+        ORDER BY id
+        LIMIT ?`
+
+	ctx, cancel := withOperation(ctx, "sqliteMovieChangeModel.Since", m.Timeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, token.ID, limit+1)
+	if err != nil {
+		return nil, token, false, err
+	}
+
+	defer rows.Close()
+
+	var (
+		next    = token
+		hasMore = false
+		changes = []*MovieChange{}
+		latest  = make(map[int64]int)
+	)
+
+	for rows.Next() {
+		if len(changes) == limit {
+			hasMore = true
+			break
+		}
+
+		var (
+			change MovieChange
+			id     int64
+		)
+
+		err := rows.Scan(&id, &change.MovieID, &change.Operation, &change.ChangedAt)
+		if err != nil {
+			return nil, token, false, err
+		}
+
+		next = ChangeToken{TxID: uint64(id), ID: id}
+
+		if i, ok := latest[change.MovieID]; ok {
+			changes[i] = nil
+		}
+
+		latest[change.MovieID] = len(changes)
+		changes = append(changes, &change)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, token, false, err
+	}
+
+	rows.Close()
+
+	compacted := changes[:0]
+	for _, change := range changes {
+		if change != nil {
+			compacted = append(compacted, change)
+		}
+	}
+
+	err = m.attachMovies(ctx, compacted)
+	if err != nil {
+		return nil, token, false, err
+	}
+
+	return compacted, next, hasMore, nil
+}
+
+func (m sqliteMovieChangeModel) attachMovies(ctx context.Context, changes []*MovieChange) error {
+	if len(changes) == 0 {
+		return nil
+	}
+
+	ids := make([]int64, 0, len(changes))
+	for _, change := range changes {
+		ids = append(ids, change.MovieID)
+	}
+
+	query := `
+        SELECT id, created_at, updated_at, title, year, runtime, genres, status, release_dates, created_by, version
+        FROM movies
+        WHERE id IN (SELECT value FROM json_each(?))`
+
+	rows, err := m.DB.QueryContext(ctx, query, sqliteArray{ids})
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+
+	movies := make(map[int64]*Movie, len(ids))
+
+	for rows.Next() {
+		var movie Movie
+
+		err := rows.Scan(
+			&movie.ID,
+			&movie.CreatedAt,
+			&movie.UpdatedAt,
+			&movie.Title,
+			&movie.Year,
+			&movie.Runtime,
+			sqliteArray{&movie.Genres},
+			&movie.Status,
+			&movie.ReleaseDates,
+			&movie.CreatedBy,
+			&movie.Version,
+		)
+		if err != nil {
+			return err
+		}
+
+		movies[movie.ID] = &movie
+	}
+
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for _, change := range changes {
+		change.Movie = movies[change.MovieID]
+	}
+
+	return nil
+}
+
+type sqliteUserModel struct {
+	DB      DBTX
+	Timeout time.Duration
+}
+
+func (m sqliteUserModel) Insert(ctx context.Context, user *User) error {
+	query := `
+        INSERT INTO users (name, email, password_hash, activated, created_at)
+        VALUES (?, ?, ?, ?, ?)
+        RETURNING id, created_at, version`
+
+	args := []any{user.Name, user.Email, user.Password.hash, user.Activated, sqliteNow()}
+
+	ctx, cancel := withOperation(ctx, "sqliteUserModel.Insert", m.Timeout)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.ID, &user.CreatedAt, &user.Version)
+	if err != nil {
+		switch {
+		case violates(err, "users_email_key"):
+			return ErrDuplicateEmail
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m sqliteUserModel) Get(ctx context.Context, id int64) (*User, error) {
+	query := `
+        SELECT id, created_at, name, email, password_hash, activated, deletion_requested_at, version
+        FROM users
+        WHERE id = ?`
+
+	var user User
+
+	ctx, cancel := withOperation(ctx, "sqliteUserModel.Get", m.Timeout)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.DeletionRequestedAt,
+		&user.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &user, nil
+}
+
+func (m sqliteUserModel) GetByEmail(ctx context.Context, email string) (*User, error) {
+	query := `
+        SELECT id, created_at, name, email, password_hash, activated, deletion_requested_at, version
+        FROM users
+        WHERE email = ?`
+
+	var user User
+
+	ctx, cancel := withOperation(ctx, "sqliteUserModel.GetByEmail", m.Timeout)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, email).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.DeletionRequestedAt,
+		&user.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &user, nil
+}
+
+func (m sqliteUserModel) Update(ctx context.Context, user *User) error {
+	query := `
+        UPDATE users
+        SET name = ?, email = ?, password_hash = ?, activated = ?, deletion_requested_at = ?, version = version + 1
+        WHERE id = ? AND version = ?
+        RETURNING version`
+
+	args := []any{
+		user.Name,
+		user.Email,
+		user.Password.hash,
+		user.Activated,
+		sqliteTime(user.DeletionRequestedAt),
+		user.ID,
+		user.Version,
+	}
+
+	ctx, cancel := withOperation(ctx, "sqliteUserModel.Update", m.Timeout)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.Version)
+	if err != nil {
+		switch {
+		case violates(err, "users_email_key"):
+			return ErrDuplicateEmail
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m sqliteUserModel) GetForToken(ctx context.Context, tokenScope, tokenPlaintext string) (*User, error) {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query := `
+        SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.deletion_requested_at, users.version
+        FROM users
+        INNER JOIN tokens
+        ON users.id = tokens.user_id
+        WHERE tokens.hash = ?
+        AND tokens.scope = ?
+        AND tokens.expiry > ?`
+
+	args := []any{tokenHash[:], tokenScope, sqliteNow()}
+
+	var user User
+
+	ctx, cancel := withOperation(ctx, "sqliteUserModel.GetForToken", m.Timeout)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.DeletionRequestedAt,
+		&user.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &user, nil
+}
+
+// PurgeDeleted clears created_by itself rather than leaving it to the foreign
+// key, so that the movie_changes_update trigger records the change.
+func (m sqliteUserModel) PurgeDeleted(ctx context.Context, before time.Time) ([]int64, error) {
+	ctx, cancel := withOperation(ctx, "sqliteUserModel.PurgeDeleted", m.Timeout)
+	defer cancel()
+
+	before = before.UTC().Round(time.Second)
+
+	query := `
+        UPDATE movies
+        SET created_by = NULL, updated_at = ?2, version = version + 1
+        WHERE created_by IN (SELECT id FROM users WHERE deletion_requested_at <= ?1)`
+
+	_, err := m.DB.ExecContext(ctx, query, before, sqliteNow())
+	if err != nil {
+		return nil, err
+	}
+
+	query = `
+        DELETE FROM idempotency_keys
+        WHERE user_id IN (SELECT id FROM users WHERE deletion_requested_at <= ?)`
+
+	_, err = m.DB.ExecContext(ctx, query, before)
+	if err != nil {
+		return nil, err
+	}
+
+	query = `
+        DELETE FROM users
+        WHERE deletion_requested_at <= ?
+        RETURNING id`
+
+	rows, err := m.DB.QueryContext(ctx, query, before)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int64
+
+	for rows.Next() {
+		var id int64
+
+		err := rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+
+		ids = append(ids, id)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return ids, nil
+}
+
+type sqliteTokenModel struct {
+	DB      DBTX
+	Timeout time.Duration
+}
+
+func (m sqliteTokenModel) New(ctx context.Context, userID int64, ttl time.Duration, scope string) (*Token, error) {
+	token, err := GenerateToken(userID, ttl, scope)
+	if err != nil {
+		return nil, err
+	}
+
+	err = m.Insert(ctx, token)
+	return token, err
+}
+
+func (m sqliteTokenModel) Insert(ctx context.Context, token *Token) error {
+	query := `
+        INSERT INTO tokens (hash, user_id, expiry, scope, ip, user_agent, family, created_at)
+        VALUES (?, ?, ?, ?, ?, ?, NULLIF(?, ''), ?)
+        RETURNING id, created_at`
+
+	args := []any{token.Hash, token.UserID, token.Expiry.UTC().Round(time.Second), token.Scope, token.IP, token.UserAgent, token.Family, sqliteNow()}
+
+	ctx, cancel := withOperation(ctx, "sqliteTokenModel.Insert", m.Timeout)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&token.ID, &token.CreatedAt)
+}
+
+func (m sqliteTokenModel) Touch(ctx context.Context, tokenPlaintext, ip, userAgent string, notBefore time.Time) error {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query := `
+        UPDATE tokens
+        SET last_used_at = ?2, ip = ?3, user_agent = ?4
+        WHERE hash = ?1 AND (last_used_at IS NULL OR last_used_at < ?5)`
+
+	ctx, cancel := withOperation(ctx, "sqliteTokenModel.Touch", m.Timeout)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, tokenHash[:], sqliteNow(), ip, userAgent, notBefore.UTC().Round(time.Second))
+	return err
+}
+
+func (m sqliteTokenModel) GetByPlaintext(ctx context.Context, scope, tokenPlaintext string) (*Token, error) {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query := `
+        SELECT id, hash, user_id, expiry, scope, created_at, last_used_at, ip, user_agent, COALESCE(family, ''), rotated_at
+        FROM tokens
+        WHERE hash = ? AND scope = ? AND expiry > ?`
+
+	ctx, cancel := withOperation(ctx, "sqliteTokenModel.GetByPlaintext", m.Timeout)
+	defer cancel()
+
+	token, err := scanToken(m.DB.QueryRowContext(ctx, query, tokenHash[:], scope, sqliteNow()))
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return token, nil
+}
+
+func (m sqliteTokenModel) MarkRotated(ctx context.Context, id int64) error {
+	query := `
+        UPDATE tokens
+        SET rotated_at = ?
+        WHERE id = ? AND rotated_at IS NULL`
+
+	ctx, cancel := withOperation(ctx, "sqliteTokenModel.MarkRotated", m.Timeout)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, sqliteNow(), id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrEditConflict
+	}
+
+	return nil
+}
+
+func (m sqliteTokenModel) Delete(ctx context.Context, scope string, userID int64, tokenPlaintext string) error {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query := `
+        DELETE FROM tokens
+        WHERE user_id = ?3 AND (
+            (hash = ?1 AND scope = ?2)
+            OR family IN (SELECT family FROM tokens WHERE hash = ?1 AND scope = ?2 AND user_id = ?3)
+        )`
+
+	ctx, cancel := withOperation(ctx, "sqliteTokenModel.Delete", m.Timeout)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, tokenHash[:], scope, userID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+func (m sqliteTokenModel) DeleteByID(ctx context.Context, scope string, userID, id int64) error {
+	query := `
+        DELETE FROM tokens
+        WHERE user_id = ?3 AND (
+            (id = ?1 AND scope = ?2)
+            OR family IN (SELECT family FROM tokens WHERE id = ?1 AND scope = ?2 AND user_id = ?3)
+        )`
+
+	ctx, cancel := withOperation(ctx, "sqliteTokenModel.DeleteByID", m.Timeout)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id, scope, userID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+func (m sqliteTokenModel) DeleteFamily(ctx context.Context, userID int64, family string) error {
+	query := `
+        DELETE FROM tokens
+        WHERE user_id = ? AND family = ?`
+
+	ctx, cancel := withOperation(ctx, "sqliteTokenModel.DeleteFamily", m.Timeout)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID, family)
+	return err
+}
+
+func (m sqliteTokenModel) DeleteAllForUser(ctx context.Context, scope string, userID int64) error {
+	query := `
+        DELETE FROM tokens
+        WHERE scope = ? AND user_id = ?`
+
+	ctx, cancel := withOperation(ctx, "sqliteTokenModel.DeleteAllForUser", m.Timeout)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, scope, userID)
+	return err
+}
+
+func (m sqliteTokenModel) GetAllForUser(ctx context.Context, userID int64) ([]*Token, error) {
+	query := `
+        SELECT id, hash, user_id, expiry, scope, created_at, last_used_at, ip, user_agent, COALESCE(family, ''), rotated_at
+        FROM tokens
+        WHERE user_id = ? AND expiry > ?
+        ORDER BY created_at DESC, id DESC`
+
+	ctx, cancel := withOperation(ctx, "sqliteTokenModel.GetAllForUser", m.Timeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID, sqliteNow())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []*Token{}
+
+	for rows.Next() {
+		token, err := scanToken(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		tokens = append(tokens, token)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return tokens, nil
+}
+
+type sqlitePermissionModel struct {
+	DB      DBTX
+	Timeout time.Duration
+}
+
+func (m sqlitePermissionModel) GetAllForUser(ctx context.Context, userID int64) (Permissions, error) {
+	query := `
+        SELECT permissions.code
+        FROM permissions
+        INNER JOIN users_permissions ON users_permissions.permission_id = permissions.id
+        INNER JOIN users ON users_permissions.user_id = users.id
+        WHERE users.id = ?`
+
+	ctx, cancel := withOperation(ctx, "sqlitePermissionModel.GetAllForUser", m.Timeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var permissions Permissions
+
+	for rows.Next() {
+		var permission string
+
+		err := rows.Scan(&permission)
+		if err != nil {
+			return nil, err
+		}
+
+		permissions = append(permissions, permission)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return permissions, nil
+}
+
+func (m sqlitePermissionModel) AddForUser(ctx context.Context, userID int64, codes ...string) error {
+	query := `
+        INSERT INTO users_permissions
+        SELECT ?, permissions.id FROM permissions WHERE permissions.code IN (SELECT value FROM json_each(?))`
+
+	ctx, cancel := withOperation(ctx, "sqlitePermissionModel.AddForUser", m.Timeout)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID, sqliteArray{codes})
+	return err
+}
+
+type sqliteIdempotencyModel struct {
+	DB      DBTX
+	Timeout time.Duration
+}
+
+func (m sqliteIdempotencyModel) Begin(ctx context.Context, userID int64, key string, fingerprint []byte, ttl time.Duration) (*IdempotentResponse, error) {
+	query := `
+        INSERT INTO idempotency_keys (user_id, key, fingerprint, created_at, expiry)
+        VALUES (?1, ?2, ?3, ?4, ?5)
+        ON CONFLICT (user_id, key) DO UPDATE
+        SET fingerprint = excluded.fingerprint, status_code = NULL, response_headers = NULL,
+            response_body = NULL, created_at = excluded.created_at, expiry = excluded.expiry
+        WHERE idempotency_keys.expiry <= ?4
+        OR (idempotency_keys.status_code IS NULL AND idempotency_keys.created_at <= ?6)
+        RETURNING true`
+
+	now := sqliteNow()
+
+	args := []any{userID, key, fingerprint, now, now.Add(ttl), now.Add(-IdempotencyInFlightTimeout)}
+
+	ctx, cancel := withOperation(ctx, "sqliteIdempotencyModel.Begin", m.Timeout)
+	defer cancel()
+
+	var claimed bool
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&claimed)
+	switch {
+	case err == nil:
+		return nil, nil
+	case !errors.Is(err, sql.ErrNoRows):
+		return nil, err
+	}
+
+	query = `
+        SELECT fingerprint, status_code, response_headers, response_body
+        FROM idempotency_keys
+        WHERE user_id = ? AND key = ?`
+
+	var (
+		storedFingerprint []byte
+		statusCode        sql.NullInt32
+		headers           sql.NullString
+		body              []byte
+	)
+
+	err = m.DB.QueryRowContext(ctx, query, userID, key).Scan(&storedFingerprint, &statusCode, &headers, &body)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrIdempotencyKeyInFlight
+		default:
+			return nil, err
+		}
+	}
+
+	if string(storedFingerprint) != string(fingerprint) {
+		return nil, ErrIdempotencyKeyMismatch
+	}
+
+	if !statusCode.Valid {
+		return nil, ErrIdempotencyKeyInFlight
+	}
+
+	response := &IdempotentResponse{
+		StatusCode: int(statusCode.Int32),
+		Body:       body,
+	}
+
+	if headers.String != "" {
+		err = json.Unmarshal([]byte(headers.String), &response.Header)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return response, nil
+}
+
+func (m sqliteIdempotencyModel) Complete(ctx context.Context, userID int64, key string, response *IdempotentResponse) error {
+	headers, err := json.Marshal(response.Header)
+	if err != nil {
+		return err
+	}
+
+	query := `
+        UPDATE idempotency_keys
+        SET status_code = ?, response_headers = ?, response_body = ?
+        WHERE user_id = ? AND key = ?`
+
+	args := []any{response.StatusCode, string(headers), response.Body, userID, key}
+
+	ctx, cancel := withOperation(ctx, "sqliteIdempotencyModel.Complete", m.Timeout)
+	defer cancel()
+
+	_, err = m.DB.ExecContext(ctx, query, args...)
+	return err
+}
+
+func (m sqliteIdempotencyModel) Release(ctx context.Context, userID int64, key string) error {
+	query := `
+        DELETE FROM idempotency_keys
+        WHERE user_id = ? AND key = ? AND status_code IS NULL`
+
+	ctx, cancel := withOperation(ctx, "sqliteIdempotencyModel.Release", m.Timeout)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID, key)
+	return err
+}
+
+func (m sqliteIdempotencyModel) DeleteExpired(ctx context.Context) error {
+	query := `
+        DELETE FROM idempotency_keys
+        WHERE expiry <= ?`
+
+	ctx, cancel := withOperation(ctx, "sqliteIdempotencyModel.DeleteExpired", m.Timeout)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, sqliteNow())
+	return err
+}
+
+type sqliteAPIKeyModel struct {
+	DB      DBTX
+	Timeout time.Duration
+}
+
+func (m sqliteAPIKeyModel) Insert(ctx context.Context, key *APIKey) error {
+	query := `
+        INSERT INTO api_keys (hash, user_id, name, permissions, expiry, created_at)
+        VALUES (?, ?, ?, ?, ?, ?)
+        RETURNING id, created_at`
+
+	args := []any{key.Hash, key.UserID, key.Name, sqliteArray{key.Permissions}, sqliteTime(key.Expiry), sqliteNow()}
+
+	ctx, cancel := withOperation(ctx, "sqliteAPIKeyModel.Insert", m.Timeout)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&key.ID, &key.CreatedAt)
+}
+
+func (m sqliteAPIKeyModel) GetByPlaintext(ctx context.Context, keyPlaintext string) (*APIKey, error) {
+	keyHash := sha256.Sum256([]byte(keyPlaintext))
+
+	query := `
+        SELECT id, hash, user_id, name, permissions, created_at, expiry
+        FROM api_keys
+        WHERE hash = ?1 AND (expiry IS NULL OR expiry > ?2)`
+
+	ctx, cancel := withOperation(ctx, "sqliteAPIKeyModel.GetByPlaintext", m.Timeout)
+	defer cancel()
+
+	key, err := scanAPIKey(m.DB.QueryRowContext(ctx, query, keyHash[:], sqliteNow()), sqliteArrayScanner)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return key, nil
+}
+
+func (m sqliteAPIKeyModel) GetAllForUser(ctx context.Context, userID int64) ([]*APIKey, error) {
+	query := `
+        SELECT id, hash, user_id, name, permissions, created_at, expiry
+        FROM api_keys
+        WHERE user_id = ?
+        ORDER BY created_at DESC, id DESC`
+
+	ctx, cancel := withOperation(ctx, "sqliteAPIKeyModel.GetAllForUser", m.Timeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanAPIKeys(rows, sqliteArrayScanner)
+}
+
+func (m sqliteAPIKeyModel) Delete(ctx context.Context, userID, id int64) error {
+	query := `
+        DELETE FROM api_keys
+        WHERE id = ? AND user_id = ?`
+
+	ctx, cancel := withOperation(ctx, "sqliteAPIKeyModel.Delete", m.Timeout)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id, userID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+func (m sqliteAPIKeyModel) DeleteAllForUser(ctx context.Context, userID int64) error {
+	query := `
+        DELETE FROM api_keys
+        WHERE user_id = ?`
+
+	ctx, cancel := withOperation(ctx, "sqliteAPIKeyModel.DeleteAllForUser", m.Timeout)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID)
+	return err
+}
+
+type sqliteAuditModel struct {
+	DB      DBTX
+	Timeout time.Duration
+}
+
+func (m sqliteAuditModel) Insert(ctx context.Context, entry *AuditEntry) error {
+	query := `
+        INSERT INTO audit_log (user_id, action, created_at)
+        VALUES (?, ?, ?)
+        RETURNING id, created_at`
+
+	ctx, cancel := withOperation(ctx, "sqliteAuditModel.Insert", m.Timeout)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, entry.UserID, entry.Action, sqliteNow()).Scan(&entry.ID, &entry.CreatedAt)
+}
+
+func (m sqliteAuditModel) GetAllForUser(ctx context.Context, userID int64) ([]*AuditEntry, error) {
+	query := `
+        SELECT id, user_id, action, created_at
+        FROM audit_log
+        WHERE user_id = ?
+        ORDER BY id`
+
+	ctx, cancel := withOperation(ctx, "sqliteAuditModel.GetAllForUser", m.Timeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanAuditEntries(rows)
+}
+
+type sqliteDenylistModel struct {
+	DB      DBTX
+	Timeout time.Duration
+}
+
+func (m sqliteDenylistModel) Add(ctx context.Context, key string, expiry time.Time) error {
+	query := `
+        INSERT INTO token_denylist (key, expiry)
+        VALUES (?, ?)
+        ON CONFLICT (key) DO UPDATE SET expiry = max(token_denylist.expiry, excluded.expiry)`
+
+	ctx, cancel := withOperation(ctx, "sqliteDenylistModel.Add", m.Timeout)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, key, expiry.UTC().Round(time.Second))
+	return err
+}
+
+func (m sqliteDenylistModel) Contains(ctx context.Context, key string) (bool, error) {
+	query := `
+        SELECT EXISTS (SELECT 1 FROM token_denylist WHERE key = ? AND expiry > ?)`
+
+	ctx, cancel := withOperation(ctx, "sqliteDenylistModel.Contains", m.Timeout)
+	defer cancel()
+
+	var denied bool
+
+	err := m.DB.QueryRowContext(ctx, query, key, sqliteNow()).Scan(&denied)
+	return denied, err
+}
+
+func (m sqliteDenylistModel) DeleteExpired(ctx context.Context) error {
+	query := `
+        DELETE FROM token_denylist
+        WHERE expiry <= ?`
+
+	ctx, cancel := withOperation(ctx, "sqliteDenylistModel.DeleteExpired", m.Timeout)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, sqliteNow())
+	return err
+}
+
+type sqliteIdentityModel struct {
+	DB      DBTX
+	Timeout time.Duration
+}
+
+func (m sqliteIdentityModel) Insert(ctx context.Context, identity *Identity) error {
+	query := `
+        INSERT INTO user_identities (issuer, subject, user_id, created_at)
+        VALUES (?, ?, ?, ?)
+        RETURNING created_at`
+
+	ctx, cancel := withOperation(ctx, "sqliteIdentityModel.Insert", m.Timeout)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, identity.Issuer, identity.Subject, identity.UserID, sqliteNow()).Scan(&identity.CreatedAt)
+}
+
+func (m sqliteIdentityModel) Get(ctx context.Context, issuer, subject string) (*Identity, error) {
+	query := `
+        SELECT issuer, subject, user_id, created_at
+        FROM user_identities
+        WHERE issuer = ? AND subject = ?`
+
+	ctx, cancel := withOperation(ctx, "sqliteIdentityModel.Get", m.Timeout)
+	defer cancel()
+
+	var identity Identity
+
+	err := m.DB.QueryRowContext(ctx, query, issuer, subject).Scan(&identity.Issuer, &identity.Subject, &identity.UserID, &identity.CreatedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &identity, nil
+}
+
+func (m sqliteIdentityModel) GetAllForUser(ctx context.Context, userID int64) ([]*Identity, error) {
+	query := `
+        SELECT issuer, subject, user_id, created_at
+        FROM user_identities
+        WHERE user_id = ?
+        ORDER BY created_at`
+
+	ctx, cancel := withOperation(ctx, "sqliteIdentityModel.GetAllForUser", m.Timeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanIdentities(rows)
+}
+
+type sqliteOIDCLoginModel struct {
+	DB      DBTX
+	Timeout time.Duration
+}
+
+func (m sqliteOIDCLoginModel) Insert(ctx context.Context, login *OIDCLogin) error {
+	query := `
+        INSERT INTO oidc_logins (state, nonce, verifier, secret_hash, expiry)
+        VALUES (?, ?, ?, ?, ?)`
+
+	ctx, cancel := withOperation(ctx, "sqliteOIDCLoginModel.Insert", m.Timeout)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, login.State, login.Nonce, login.Verifier, login.SecretHash, login.Expiry.UTC().Round(time.Second))
+	return err
+}
+
+func (m sqliteOIDCLoginModel) Take(ctx context.Context, state string, secretHash []byte) (*OIDCLogin, error) {
+	query := `
+        DELETE FROM oidc_logins
+        WHERE state = ? AND secret_hash = ?
+        RETURNING state, nonce, verifier, secret_hash, expiry`
+
+	ctx, cancel := withOperation(ctx, "sqliteOIDCLoginModel.Take", m.Timeout)
+	defer cancel()
+
+	var login OIDCLogin
+
+	err := m.DB.QueryRowContext(ctx, query, state, secretHash).Scan(&login.State, &login.Nonce, &login.Verifier, &login.SecretHash, &login.Expiry)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	if !login.Expiry.After(time.Now()) {
+		return nil, ErrRecordNotFound
+	}
+
+	return &login, nil
+}
+
+func (m sqliteOIDCLoginModel) DeleteExpired(ctx context.Context) error {
+	query := `
+        DELETE FROM oidc_logins
+        WHERE expiry <= ?`
+
+	ctx, cancel := withOperation(ctx, "sqliteOIDCLoginModel.DeleteExpired", m.Timeout)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, sqliteNow())
+	return err
+}
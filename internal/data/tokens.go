@@ -7,6 +7,7 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"encoding/base32"
+	"errors"
 	"time"
 )
 
@@ -14,17 +15,35 @@ const (
 	ScopeActivation     = "activation"
 	ScopeAuthentication = "authentication"
 	ScopePasswordReset  = "password-reset"
+	ScopeRefresh        = "refresh"
 )
 
+// Token is a credential sent to the user. Authentication tokens also record
+// the session they belong to: when it started, when the token was last used
+// and the address and user agent it was last used from.
+//
+// The authentication and refresh tokens issued from one login share a
+// Family, and revoking any of them revokes the whole family. A refresh token
+// is kept once it has been exchanged, with RotatedAt set, so that its reuse
+// can be detected.
 type Token struct {
-	Plaintext string    `json:"token"`
-	Hash      []byte    `json:"-"`
-	UserID    int64     `json:"-"`
-	Expiry    time.Time `json:"expiry"`
-	Scope     string    `json:"-"`
+	ID         int64      `json:"-"`
+	Plaintext  string     `json:"token"`
+	Hash       []byte     `json:"-"`
+	UserID     int64      `json:"-"`
+	Expiry     time.Time  `json:"expiry"`
+	Scope      string     `json:"-"`
+	CreatedAt  time.Time  `json:"-"`
+	LastUsedAt *time.Time `json:"-"`
+	IP         string     `json:"-"`
+	UserAgent  string     `json:"-"`
+	Family     string     `json:"-"`
+	RotatedAt  *time.Time `json:"-"`
 }
 
-func generateToken(userID int64, ttl time.Duration, scope string) (*Token, error) {
+// GenerateToken returns a new token without storing it; see TokenStore.New
+// for doing both.
+func GenerateToken(userID int64, ttl time.Duration, scope string) (*Token, error) {
 	token := &Token{
 		UserID: userID,
 		Expiry: time.Now().Add(ttl),
@@ -46,47 +65,265 @@ func generateToken(userID int64, ttl time.Duration, scope string) (*Token, error
 	return token, nil
 }
 
+// NewTokenFamily returns a random identifier for the tokens issued from one
+// login.
+func NewTokenFamily() (string, error) {
+	randomBytes := make([]byte, 16)
+
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return "", err
+	}
+
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes), nil
+}
+
 func ValidateTokenPlaintext(v *validator.Validator, tokenPlaintext string) {
 	v.Check(tokenPlaintext != "", "token", "must be provided")
 	v.Check(len(tokenPlaintext) == 26, "token", "must be 26 bytes long")
 }
 
 type TokenModel struct {
-	DB *sql.DB
+	DB      DBTX
+	Timeout time.Duration
 }
 
-func (m TokenModel) New(userID int64, ttl time.Duration, scope string) (*Token, error) {
-	token, err := generateToken(userID, ttl, scope)
+func (m TokenModel) New(ctx context.Context, userID int64, ttl time.Duration, scope string) (*Token, error) {
+	token, err := GenerateToken(userID, ttl, scope)
 	if err != nil {
 		return nil, err
 	}
 
-	err = m.Insert(token)
+	err = m.Insert(ctx, token)
 	return token, err
 }
 
-func (m TokenModel) Insert(token *Token) error {
+func (m TokenModel) Insert(ctx context.Context, token *Token) error {
 	query := `
-        INSERT INTO tokens (hash, user_id, expiry, scope) 
-        VALUES ($1, $2, $3, $4)`
+        INSERT INTO tokens (hash, user_id, expiry, scope, ip, user_agent, family) 
+        VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, ''))
+        RETURNING id, created_at`
 
-	args := []any{token.Hash, token.UserID, token.Expiry, token.Scope}
+	args := []any{token.Hash, token.UserID, token.Expiry, token.Scope, token.IP, token.UserAgent, token.Family}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := withOperation(ctx, "TokenModel.Insert", m.Timeout)
 	defer cancel()
 
-	_, err := m.DB.ExecContext(ctx, query, args...)
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&token.ID, &token.CreatedAt)
+}
+
+// Touch records that a token has just been used, and from where. Writes are
+// skipped when the token was already marked as used since notBefore.
+func (m TokenModel) Touch(ctx context.Context, tokenPlaintext, ip, userAgent string, notBefore time.Time) error {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query := `
+        UPDATE tokens
+        SET last_used_at = NOW(), ip = $2, user_agent = $3
+        WHERE hash = $1 AND (last_used_at IS NULL OR last_used_at < $4)`
+
+	ctx, cancel := withOperation(ctx, "TokenModel.Touch", m.Timeout)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, tokenHash[:], ip, userAgent, notBefore)
 	return err
 }
 
-func (m TokenModel) DeleteAllForUser(scope string, userID int64) error {
+// GetByPlaintext returns an unexpired token, including a refresh token that
+// has already been rotated.
+func (m TokenModel) GetByPlaintext(ctx context.Context, scope, tokenPlaintext string) (*Token, error) {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query := `
+        SELECT id, hash, user_id, expiry, scope, created_at, last_used_at, ip, user_agent, COALESCE(family, ''), rotated_at
+        FROM tokens
+        WHERE hash = $1 AND scope = $2 AND expiry > NOW()`
+
+	ctx, cancel := withOperation(ctx, "TokenModel.GetByPlaintext", m.Timeout)
+	defer cancel()
+
+	token, err := scanToken(m.DB.QueryRowContext(ctx, query, tokenHash[:], scope))
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return token, nil
+}
+
+// MarkRotated records that a refresh token has been exchanged. It returns
+// ErrEditConflict when the token was already rotated or no longer exists.
+func (m TokenModel) MarkRotated(ctx context.Context, id int64) error {
+	query := `
+        UPDATE tokens
+        SET rotated_at = NOW()
+        WHERE id = $1 AND rotated_at IS NULL`
+
+	ctx, cancel := withOperation(ctx, "TokenModel.MarkRotated", m.Timeout)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrEditConflict
+	}
+
+	return nil
+}
+
+// Delete revokes a single token, along with the rest of its family, returning
+// ErrRecordNotFound when the user has no such token in scope.
+func (m TokenModel) Delete(ctx context.Context, scope string, userID int64, tokenPlaintext string) error {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query := `
+        DELETE FROM tokens
+        WHERE user_id = $3 AND (
+            (hash = $1 AND scope = $2)
+            OR family IN (SELECT family FROM tokens WHERE hash = $1 AND scope = $2 AND user_id = $3)
+        )`
+
+	ctx, cancel := withOperation(ctx, "TokenModel.Delete", m.Timeout)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, tokenHash[:], scope, userID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// DeleteByID is Delete for a token identified by its ID.
+func (m TokenModel) DeleteByID(ctx context.Context, scope string, userID, id int64) error {
+	query := `
+        DELETE FROM tokens
+        WHERE user_id = $3 AND (
+            (id = $1 AND scope = $2)
+            OR family IN (SELECT family FROM tokens WHERE id = $1 AND scope = $2 AND user_id = $3)
+        )`
+
+	ctx, cancel := withOperation(ctx, "TokenModel.DeleteByID", m.Timeout)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id, scope, userID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// DeleteFamily revokes every token issued from the same login.
+func (m TokenModel) DeleteFamily(ctx context.Context, userID int64, family string) error {
+	query := `
+        DELETE FROM tokens
+        WHERE user_id = $1 AND family = $2`
+
+	ctx, cancel := withOperation(ctx, "TokenModel.DeleteFamily", m.Timeout)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID, family)
+	return err
+}
+
+func (m TokenModel) DeleteAllForUser(ctx context.Context, scope string, userID int64) error {
 	query := `
         DELETE FROM tokens 
         WHERE scope = $1 AND user_id = $2`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := withOperation(ctx, "TokenModel.DeleteAllForUser", m.Timeout)
 	defer cancel()
 
 	_, err := m.DB.ExecContext(ctx, query, scope, userID)
 	return err
 }
+
+// GetAllForUser returns the user's unexpired tokens, most recently created
+// first. Plaintext is never stored, so it is always empty.
+func (m TokenModel) GetAllForUser(ctx context.Context, userID int64) ([]*Token, error) {
+	query := `
+        SELECT id, hash, user_id, expiry, scope, created_at, last_used_at, ip, user_agent, COALESCE(family, ''), rotated_at
+        FROM tokens
+        WHERE user_id = $1 AND expiry > NOW()
+        ORDER BY created_at DESC, id DESC`
+
+	ctx, cancel := withOperation(ctx, "TokenModel.GetAllForUser", m.Timeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []*Token{}
+
+	for rows.Next() {
+		token, err := scanToken(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		tokens = append(tokens, token)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return tokens, nil
+}
+
+// scanToken reads the columns selected by GetByPlaintext and GetAllForUser.
+func scanToken(row interface{ Scan(dest ...any) error }) (*Token, error) {
+	var token Token
+
+	err := row.Scan(
+		&token.ID,
+		&token.Hash,
+		&token.UserID,
+		&token.Expiry,
+		&token.Scope,
+		&token.CreatedAt,
+		&token.LastUsedAt,
+		&token.IP,
+		&token.UserAgent,
+		&token.Family,
+		&token.RotatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &token, nil
+}
@@ -0,0 +1,150 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// maxTxAttempts is how many times a transaction is run before a
+// serialization failure is returned to the caller.
+const maxTxAttempts = 3
+
+// DBTX runs the statements of a model, either on a pool or inside a
+// transaction. Every implementation is instrumented; see instrument.
+type DBTX interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *Row
+
+	// Raw runs fn on the underlying pgx connection, for work such as COPY
+	// that database/sql cannot express, and returns ErrRawUnsupported on
+	// other databases. fn always runs in a transaction: the one the
+	// handle belongs to, or one of its own. statement describes the work
+	// in spans and logs, and fn returns the number of rows it affected.
+	Raw(ctx context.Context, statement string, fn func(ctx context.Context, conn *pgx.Conn) (int, error)) error
+}
+
+// WithTx calls fn with models whose operations all run in one transaction,
+// committed when fn returns nil and rolled back otherwise. fn is run again
+// when the transaction fails because of a concurrent one, so it must not have
+// side effects outside the models it is given. Calling WithTx on the models
+// passed to fn runs inside the same transaction.
+func (m Models) WithTx(ctx context.Context, fn func(tx Models) error) error {
+	if m.transact == nil {
+		return fn(m)
+	}
+
+	return m.transact(ctx, fn)
+}
+
+// joinTx returns a transact function for models that are already inside a
+// transaction.
+func joinTx(tx Models) func(context.Context, func(Models) error) error {
+	return func(_ context.Context, fn func(Models) error) error {
+		return fn(tx)
+	}
+}
+
+// decorate applies wrap to m and to the models WithTx passes to fn. Inside a
+// transaction wrap is given pending: work appended to it runs once the
+// transaction has finished, whether or not it committed. Outside one pending
+// is nil.
+func (m Models) decorate(wrap func(m Models, pending *[]func()) Models) Models {
+	decorated := wrap(m, nil)
+
+	decorated.transact = func(ctx context.Context, fn func(Models) error) error {
+		var pending []func()
+
+		err := m.WithTx(ctx, func(tx Models) error {
+			pending = pending[:0]
+
+			txModels := wrap(tx, &pending)
+			txModels.transact = joinTx(txModels)
+
+			return fn(txModels)
+		})
+
+		for _, run := range pending {
+			run()
+		}
+
+		return err
+	}
+
+	return decorated
+}
+
+// runTx runs fn in a transaction on db, retrying up to maxTxAttempts times
+// while it fails with ErrSerializationFailure. mapErr translates the driver
+// errors returned by BEGIN and COMMIT.
+func runTx(ctx context.Context, db *sql.DB, opts *sql.TxOptions, mapErr func(error) error, fn func(*txConn) error) error {
+	var err error
+
+	for attempt := 1; attempt <= maxTxAttempts; attempt++ {
+		err = runTxOnce(ctx, db, opts, mapErr, fn)
+		if err == nil || !errors.Is(err, ErrSerializationFailure) {
+			return err
+		}
+
+		if attempt < maxTxAttempts {
+			select {
+			case <-time.After(time.Duration(attempt) * 10 * time.Millisecond):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+
+	return fmt.Errorf("transaction failed after %d attempts: %w", maxTxAttempts, err)
+}
+
+// txConn is a transaction along with the connection it runs on, which Raw
+// needs to reach the driver connection.
+type txConn struct {
+	*sql.Tx
+	conn *sql.Conn
+}
+
+func runTxOnce(ctx context.Context, db *sql.DB, opts *sql.TxOptions, mapErr func(error) error, fn func(*txConn) error) (err error) {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return mapErr(err)
+	}
+
+	defer conn.Close()
+
+	tx, err := conn.BeginTx(ctx, opts)
+	if err != nil {
+		return mapErr(err)
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			_ = tx.Rollback()
+			panic(p)
+		}
+
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	err = fn(&txConn{Tx: tx, conn: conn})
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	// The transaction is rolled back when ctx is cancelled, so report the
+	// cancellation rather than ErrTxDone.
+	if errors.Is(err, sql.ErrTxDone) && ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	return mapErr(err)
+}
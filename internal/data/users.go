@@ -16,13 +16,14 @@ var ErrDuplicateEmail = errors.New("duplicate email")
 var AnonymousUser = &User{}
 
 type User struct {
-	ID        int64     `json:"id"`
-	CreatedAt time.Time `json:"created_at"`
-	Name      string    `json:"name"`
-	Email     string    `json:"email"`
-	Password  password  `json:"-"`
-	Activated bool      `json:"activated"`
-	Version   int       `json:"-"`
+	ID                  int64      `json:"id"`
+	CreatedAt           time.Time  `json:"created_at"`
+	Name                string     `json:"name"`
+	Email               string     `json:"email"`
+	Password            password   `json:"-"`
+	Activated           bool       `json:"activated"`
+	DeletionRequestedAt *time.Time `json:"deletion_requested_at,omitempty"`
+	Version             int        `json:"-"`
 }
 
 func (u *User) IsAnonymous() bool {
@@ -87,10 +88,11 @@ func ValidateUser(v *validator.Validator, user *User) {
 }
 
 type UserModel struct {
-	DB *sql.DB
+	DB      DBTX
+	Timeout time.Duration
 }
 
-func (m UserModel) Insert(user *User) error {
+func (m UserModel) Insert(ctx context.Context, user *User) error {
 	query := `
         INSERT INTO users (name, email, password_hash, activated) 
         VALUES ($1, $2, $3, $4)
@@ -98,13 +100,13 @@ func (m UserModel) Insert(user *User) error {
 
 	args := []any{user.Name, user.Email, user.Password.hash, user.Activated}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := withOperation(ctx, "UserModel.Insert", m.Timeout)
 	defer cancel()
 
 	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.ID, &user.CreatedAt, &user.Version)
 	if err != nil {
 		switch {
-		case err.Error() == `pq: duplicate key value violates unique constraint "users_email_key"`:
+		case violates(err, "users_email_key"):
 			return ErrDuplicateEmail
 		default:
 			return err
@@ -114,15 +116,48 @@ func (m UserModel) Insert(user *User) error {
 	return nil
 }
 
-func (m UserModel) GetByEmail(email string) (*User, error) {
+func (m UserModel) Get(ctx context.Context, id int64) (*User, error) {
 	query := `
-        SELECT id, created_at, name, email, password_hash, activated, version
+        SELECT id, created_at, name, email, password_hash, activated, deletion_requested_at, version
+        FROM users
+        WHERE id = $1`
+
+	var user User
+
+	ctx, cancel := withOperation(ctx, "UserModel.Get", m.Timeout)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.DeletionRequestedAt,
+		&user.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &user, nil
+}
+
+func (m UserModel) GetByEmail(ctx context.Context, email string) (*User, error) {
+	query := `
+        SELECT id, created_at, name, email, password_hash, activated, deletion_requested_at, version
         FROM users
         WHERE email = $1`
 
 	var user User
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := withOperation(ctx, "UserModel.GetByEmail", m.Timeout)
 	defer cancel()
 
 	err := m.DB.QueryRowContext(ctx, query, email).Scan(
@@ -132,6 +167,7 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 		&user.Email,
 		&user.Password.hash,
 		&user.Activated,
+		&user.DeletionRequestedAt,
 		&user.Version,
 	)
 	if err != nil {
@@ -146,11 +182,11 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 	return &user, nil
 }
 
-func (m UserModel) Update(user *User) error {
+func (m UserModel) Update(ctx context.Context, user *User) error {
 	query := `
         UPDATE users 
-        SET name = $1, email = $2, password_hash = $3, activated = $4, version = version + 1
-        WHERE id = $5 AND version = $6
+        SET name = $1, email = $2, password_hash = $3, activated = $4, deletion_requested_at = $5, version = version + 1
+        WHERE id = $6 AND version = $7
         RETURNING version`
 
 	args := []any{
@@ -158,17 +194,18 @@ func (m UserModel) Update(user *User) error {
 		user.Email,
 		user.Password.hash,
 		user.Activated,
+		user.DeletionRequestedAt,
 		user.ID,
 		user.Version,
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := withOperation(ctx, "UserModel.Update", m.Timeout)
 	defer cancel()
 
 	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.Version)
 	if err != nil {
 		switch {
-		case err.Error() == `pq: duplicate key value violates unique constraint "users_email_key"`:
+		case violates(err, "users_email_key"):
 			return ErrDuplicateEmail
 		case errors.Is(err, sql.ErrNoRows):
 			return ErrEditConflict
@@ -180,11 +217,11 @@ func (m UserModel) Update(user *User) error {
 	return nil
 }
 
-func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error) {
+func (m UserModel) GetForToken(ctx context.Context, tokenScope, tokenPlaintext string) (*User, error) {
 	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
 
 	query := `
-        SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.version
+        SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.deletion_requested_at, users.version
         FROM users
         INNER JOIN tokens
         ON users.id = tokens.user_id
@@ -196,7 +233,7 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 
 	var user User
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := withOperation(ctx, "UserModel.GetForToken", m.Timeout)
 	defer cancel()
 
 	err := m.DB.QueryRowContext(ctx, query, args...).Scan(
@@ -206,6 +243,7 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 		&user.Email,
 		&user.Password.hash,
 		&user.Activated,
+		&user.DeletionRequestedAt,
 		&user.Version,
 	)
 	if err != nil {
@@ -219,3 +257,65 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 
 	return &user, nil
 }
+
+// PurgeDeleted deletes the users whose deletion was requested at or before
+// before and returns their IDs. Movies they created are kept, with
+// created_by cleared. Run it in WithTx so that a failure leaves every user in
+// place.
+func (m UserModel) PurgeDeleted(ctx context.Context, before time.Time) ([]int64, error) {
+	ctx, cancel := withOperation(ctx, "UserModel.PurgeDeleted", m.Timeout)
+	defer cancel()
+
+	query := `
+        WITH updated AS (
+            UPDATE movies
+            SET created_by = NULL, updated_at = NOW(), version = version + 1
+            WHERE created_by IN (SELECT id FROM users WHERE deletion_requested_at <= $1)
+            RETURNING id
+        )
+        INSERT INTO movie_changes (movie_id, operation)
+        SELECT id, 'updated' FROM updated`
+
+	_, err := m.DB.ExecContext(ctx, query, before)
+	if err != nil {
+		return nil, err
+	}
+
+	query = `
+        DELETE FROM idempotency_keys
+        WHERE user_id IN (SELECT id FROM users WHERE deletion_requested_at <= $1)`
+
+	_, err = m.DB.ExecContext(ctx, query, before)
+	if err != nil {
+		return nil, err
+	}
+
+	query = `
+        DELETE FROM users
+        WHERE deletion_requested_at <= $1
+        RETURNING id`
+
+	rows, err := m.DB.QueryContext(ctx, query, before)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int64
+
+	for rows.Next() {
+		var id int64
+
+		err := rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+
+		ids = append(ids, id)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return ids, nil
+}
@@ -0,0 +1,370 @@
+// Package migrate applies the embedded SQL migrations. It keeps its state in
+// the schema_migrations table used by golang-migrate, so databases migrated
+// with that tool can be taken over without any change.
+package migrate
+
+import (
+	"autherain/golang_arxiv/migrations"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrDirty          = errors.New("database is dirty: a previous migration failed part way and must be fixed by hand")
+	ErrUnknownVersion = errors.New("unknown migration version")
+)
+
+// lockKey identifies the Postgres advisory lock held while migrating, so that
+// replicas starting together do not apply the same migration twice.
+const lockKey int64 = 0x6d6967726174650a
+
+type Migration struct {
+	Version uint
+	Name    string
+	up      string
+	down    string
+}
+
+type Status struct {
+	Version    uint
+	Dirty      bool
+	Migrations []Migration
+}
+
+type Migrator struct {
+	db         *sql.DB
+	driver     string
+	migrations []Migration
+}
+
+// New returns a migrator for db using the migrations embedded for driver,
+// which is either "postgres" or "sqlite".
+func New(db *sql.DB, driver string) (*Migrator, error) {
+	var (
+		fsys fs.FS = migrations.Postgres
+		dir        = "."
+	)
+
+	switch driver {
+	case "postgres":
+	case "sqlite":
+		fsys, dir = migrations.SQLite, "sqlite"
+	default:
+		return nil, fmt.Errorf("no migrations for driver %q", driver)
+	}
+
+	list, err := load(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Migrator{db: db, driver: driver, migrations: list}, nil
+}
+
+func load(fsys fs.FS, dir string) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[uint]*Migration)
+
+	for _, entry := range entries {
+		name := entry.Name()
+
+		var direction string
+
+		switch {
+		case strings.HasSuffix(name, ".up.sql"):
+			direction = "up"
+		case strings.HasSuffix(name, ".down.sql"):
+			direction = "down"
+		default:
+			continue
+		}
+
+		prefix, rest, found := strings.Cut(strings.TrimSuffix(name, "."+direction+".sql"), "_")
+		if !found {
+			return nil, fmt.Errorf("migration %s: name must look like NNNNNN_description.%s.sql", name, direction)
+		}
+
+		version, err := strconv.ParseUint(prefix, 10, 64)
+		if err != nil || version == 0 {
+			return nil, fmt.Errorf("migration %s: invalid version %q", name, prefix)
+		}
+
+		body, err := fs.ReadFile(fsys, path.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[uint(version)]
+		if !ok {
+			m = &Migration{Version: uint(version), Name: rest}
+			byVersion[uint(version)] = m
+		}
+
+		if direction == "up" {
+			m.up = string(body)
+		} else {
+			m.down = string(body)
+		}
+	}
+
+	list := make([]Migration, 0, len(byVersion))
+
+	for _, m := range byVersion {
+		if m.up == "" || m.down == "" {
+			return nil, fmt.Errorf("migration %06d_%s: both an up and a down file are required", m.Version, m.Name)
+		}
+
+		list = append(list, *m)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Version < list[j].Version
+	})
+
+	return list, nil
+}
+
+// Latest returns the version of the newest embedded migration.
+func (m *Migrator) Latest() uint {
+	if len(m.migrations) == 0 {
+		return 0
+	}
+
+	return m.migrations[len(m.migrations)-1].Version
+}
+
+// Version returns the applied version, which is 0 when no migration has run.
+func (m *Migrator) Version(ctx context.Context) (uint, bool, error) {
+	exists, err := m.tableExists(ctx)
+	if err != nil || !exists {
+		return 0, false, err
+	}
+
+	return m.version(ctx, m.db)
+}
+
+func (m *Migrator) Status(ctx context.Context) (Status, error) {
+	version, dirty, err := m.Version(ctx)
+	if err != nil {
+		return Status{}, err
+	}
+
+	return Status{Version: version, Dirty: dirty, Migrations: m.migrations}, nil
+}
+
+// Up applies every pending migration.
+func (m *Migrator) Up(ctx context.Context) error {
+	return m.Goto(ctx, m.Latest())
+}
+
+// Down reverts the last steps applied migrations.
+func (m *Migrator) Down(ctx context.Context, steps int) error {
+	return m.withLock(ctx, func(conn *sql.Conn) error {
+		version, err := m.cleanVersion(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		i := m.index(version)
+		if i < 0 {
+			return nil
+		}
+
+		target := uint(0)
+		if i-steps >= 0 {
+			target = m.migrations[i-steps].Version
+		}
+
+		return m.migrate(ctx, conn, version, target)
+	})
+}
+
+// Goto migrates up or down until version is the last applied migration.
+// Version 0 reverts every migration.
+func (m *Migrator) Goto(ctx context.Context, version uint) error {
+	if version != 0 && m.index(version) < 0 {
+		return fmt.Errorf("%w: %d", ErrUnknownVersion, version)
+	}
+
+	return m.withLock(ctx, func(conn *sql.Conn) error {
+		current, err := m.cleanVersion(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		return m.migrate(ctx, conn, current, version)
+	})
+}
+
+func (m *Migrator) migrate(ctx context.Context, conn *sql.Conn, from, to uint) error {
+	if from != 0 && m.index(from) < 0 {
+		return fmt.Errorf("%w: the database is at %d, which this binary does not know about", ErrUnknownVersion, from)
+	}
+
+	for _, migration := range m.migrations {
+		if migration.Version > from && migration.Version <= to {
+			err := m.apply(ctx, conn, migration.up, migration.Version)
+			if err != nil {
+				return fmt.Errorf("migration %06d_%s up: %w", migration.Version, migration.Name, err)
+			}
+		}
+	}
+
+	for i := len(m.migrations) - 1; i >= 0; i-- {
+		migration := m.migrations[i]
+
+		if migration.Version <= from && migration.Version > to {
+			previous := uint(0)
+			if i > 0 {
+				previous = m.migrations[i-1].Version
+			}
+
+			err := m.apply(ctx, conn, migration.down, previous)
+			if err != nil {
+				return fmt.Errorf("migration %06d_%s down: %w", migration.Version, migration.Name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// apply runs one migration and records the resulting version in the same
+// transaction, so a failed migration leaves nothing behind.
+func (m *Migrator) apply(ctx context.Context, conn *sql.Conn, body string, version uint) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, body)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM schema_migrations`)
+	if err != nil {
+		return err
+	}
+
+	if version > 0 {
+		_, err = tx.ExecContext(ctx, `INSERT INTO schema_migrations (version, dirty) VALUES ($1, false)`, version)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (m *Migrator) index(version uint) int {
+	for i, migration := range m.migrations {
+		if migration.Version == version {
+			return i
+		}
+	}
+
+	return -1
+}
+
+func (m *Migrator) cleanVersion(ctx context.Context, conn *sql.Conn) (uint, error) {
+	version, dirty, err := m.version(ctx, conn)
+	if err != nil {
+		return 0, err
+	}
+
+	if dirty {
+		return 0, fmt.Errorf("%w (version %d)", ErrDirty, version)
+	}
+
+	return version, nil
+}
+
+type execQuerier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// tableExists reports whether schema_migrations has been created, which
+// only happens under the lock when migrations are first run.
+func (m *Migrator) tableExists(ctx context.Context) (bool, error) {
+	query := `SELECT to_regclass('schema_migrations') IS NOT NULL`
+	if m.driver == "sqlite" {
+		query = `SELECT EXISTS (SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = 'schema_migrations')`
+	}
+
+	var exists bool
+
+	err := m.db.QueryRowContext(ctx, query).Scan(&exists)
+	return exists, err
+}
+
+func (m *Migrator) ensureTable(ctx context.Context, db execQuerier) error {
+	_, err := db.ExecContext(ctx, `
+        CREATE TABLE IF NOT EXISTS schema_migrations (
+            version bigint NOT NULL PRIMARY KEY,
+            dirty boolean NOT NULL
+        )`)
+	return err
+}
+
+func (m *Migrator) version(ctx context.Context, db execQuerier) (uint, bool, error) {
+	var (
+		version uint
+		dirty   bool
+	)
+
+	err := db.QueryRowContext(ctx, `SELECT version, dirty FROM schema_migrations LIMIT 1`).Scan(&version, &dirty)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return 0, false, nil
+		default:
+			return 0, false, err
+		}
+	}
+
+	return version, dirty, nil
+}
+
+// withLock runs fn on a single connection, creating schema_migrations first
+// if it does not exist yet. On Postgres the connection holds an advisory
+// lock for the duration, so that replicas starting together do not race to
+// create the table; SQLite already serialises the writes.
+func (m *Migrator) withLock(ctx context.Context, fn func(*sql.Conn) error) error {
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+
+	defer conn.Close()
+
+	if m.driver == "postgres" {
+		_, err = conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, lockKey)
+		if err != nil {
+			return err
+		}
+
+		defer conn.ExecContext(context.WithoutCancel(ctx), `SELECT pg_advisory_unlock($1)`, lockKey)
+	}
+
+	err = m.ensureTable(ctx, conn)
+	if err != nil {
+		return err
+	}
+
+	return fn(conn)
+}
@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"runtime"
 	"strings"
+	"sync"
 	"time"
 
 	"go.opentelemetry.io/otel"
@@ -30,6 +31,10 @@ var (
 	histograms      = make(map[string]metric.Float64Histogram)
 	gauges          = make(map[string]metric.Float64UpDownCounter)
 	lastKnownValues = make(map[string]float64)
+
+	// gaugesMu guards gauges and lastKnownValues, which are updated from
+	// more than one goroutine.
+	gaugesMu sync.Mutex
 )
 
 type ObservabilityShutdownFunc func()
@@ -120,6 +125,9 @@ func createMetrics() error {
 		{"gc_runs_total", "Total number of completed GC cycles", "", "counter"},
 		{"http_request_duration_seconds", "HTTP request duration in seconds", "s", "histogram"},
 		{"http_requests_total", "Total number of HTTP requests", "", "counter"},
+		{"db_query_duration_seconds", "Database query duration in seconds", "s", "histogram"},
+		{"cache_hits_total", "Total number of cache hits", "", "counter"},
+		{"cache_misses_total", "Total number of cache misses", "", "counter"},
 	}
 
 	for _, m := range metricsToCreate {
@@ -212,6 +220,11 @@ func sanitizePath(path string) string {
 }
 
 func IncrementCounter(ctx context.Context, name string, value int64, attrs ...attribute.KeyValue) {
+	if meter == nil {
+		// Telemetry is disabled, so there is no meter to create the counter.
+		return
+	}
+
 	counter, err := CreateDynamicCounter(name, fmt.Sprintf("Dynamic counter for %s", name), "")
 	if err != nil {
 		log.Printf("Warning: Failed to create counter '%s': %v", name, err)
@@ -221,6 +234,11 @@ func IncrementCounter(ctx context.Context, name string, value int64, attrs ...at
 }
 
 func RecordHistogram(ctx context.Context, name string, value float64, attrs ...attribute.KeyValue) {
+	if meter == nil {
+		// Telemetry is disabled, so no histogram was ever registered.
+		return
+	}
+
 	if histogram, exists := histograms[name]; exists {
 		histogram.Record(ctx, value, metric.WithAttributes(attrs...))
 	} else {
@@ -229,6 +247,9 @@ func RecordHistogram(ctx context.Context, name string, value float64, attrs ...a
 }
 
 func CreateGauge(name, description, unit string) (metric.Float64UpDownCounter, error) {
+	gaugesMu.Lock()
+	defer gaugesMu.Unlock()
+
 	if gauge, exists := gauges[name]; exists {
 		return gauge, nil
 	}
@@ -245,16 +266,24 @@ func CreateGauge(name, description, unit string) (metric.Float64UpDownCounter, e
 }
 
 func SetGauge(ctx context.Context, name string, value float64, attrs ...attribute.KeyValue) {
+	gaugesMu.Lock()
+	defer gaugesMu.Unlock()
+
 	if gauge, exists := gauges[name]; exists {
-		current := getGaugeValue(ctx, name)
+		// Each set of attributes is a series of its own, so its last value
+		// is kept apart from the others'.
+		set := attribute.NewSet(attrs...)
+		key := name + "{" + set.Encoded(attribute.DefaultEncoder()) + "}"
+
+		current := getGaugeValue(ctx, key)
 		diff := value - current
 		gauge.Add(ctx, diff, metric.WithAttributes(attrs...))
-		lastKnownValues[name] = value
+		lastKnownValues[key] = value
 	}
 }
 
-func getGaugeValue(ctx context.Context, name string) float64 {
-	return lastKnownValues[name]
+func getGaugeValue(ctx context.Context, key string) float64 {
+	return lastKnownValues[key]
 }
 
 func updateSystemMetrics(ctx context.Context) {
@@ -0,0 +1,185 @@
+package pubsub
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/uptrace/opentelemetry-go-extra/otelzap"
+	"go.uber.org/zap"
+)
+
+const (
+	minReconnectInterval = 100 * time.Millisecond
+	maxReconnectInterval = 30 * time.Second
+
+	// pingInterval is how long the listener waits for a notification before
+	// checking its connection, so that a dead connection is noticed even
+	// when nothing is being published.
+	pingInterval = time.Minute
+	pingTimeout  = 5 * time.Second
+)
+
+// Postgres is a bus built on LISTEN/NOTIFY. Events are published with
+// pg_notify on db and received on a dedicated connection opened from dsn,
+// which is re-established whenever it drops. Notifications sent while it was
+// down are lost, so a Resync is dispatched after every reconnect.
+type Postgres struct {
+	Dispatcher
+
+	db      *sql.DB
+	dsn     string
+	channel string
+	logger  *otelzap.Logger
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+// NewPostgres connects the listener and starts dispatching the events
+// received on channel. Close stops it.
+func NewPostgres(db *sql.DB, dsn, channel string, logger *otelzap.Logger) (*Postgres, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	p := &Postgres{
+		db:      db,
+		dsn:     dsn,
+		channel: channel,
+		logger:  logger,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+	}
+
+	conn, err := p.listen(ctx)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	go p.run(ctx, conn)
+
+	return p, nil
+}
+
+func (p *Postgres) Publish(ctx context.Context, event Event) {
+	payload, err := json.Marshal(event)
+	if err == nil {
+		_, err = p.db.ExecContext(ctx, "SELECT pg_notify($1, $2)", p.channel, string(payload))
+	}
+
+	if err != nil {
+		p.logger.Ctx(ctx).Error("failed to publish event",
+			zap.String("kind", string(event.Kind)),
+			zap.Int64("id", event.ID),
+			zap.Error(err),
+		)
+	}
+}
+
+// Close stops the listener and waits for it to disconnect.
+func (p *Postgres) Close() error {
+	p.cancel()
+	<-p.done
+
+	return nil
+}
+
+func (p *Postgres) listen(ctx context.Context) (*pgx.Conn, error) {
+	conn, err := pgx.Connect(ctx, p.dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = conn.Exec(ctx, "LISTEN "+pgx.Identifier{p.channel}.Sanitize())
+	if err != nil {
+		conn.Close(context.Background())
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+func (p *Postgres) run(ctx context.Context, conn *pgx.Conn) {
+	defer close(p.done)
+
+	for {
+		err := p.receive(ctx, conn)
+		conn.Close(context.Background())
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		p.logger.Warn("event listener disconnected", zap.String("channel", p.channel), zap.Error(err))
+
+		conn = p.reconnect(ctx)
+		if conn == nil {
+			return
+		}
+
+		p.logger.Info("event listener reconnected", zap.String("channel", p.channel))
+		p.Dispatch(Event{Kind: Resync})
+	}
+}
+
+// receive dispatches notifications until the connection fails.
+func (p *Postgres) receive(ctx context.Context, conn *pgx.Conn) error {
+	for {
+		waitCtx, cancel := context.WithTimeout(ctx, pingInterval)
+		notification, err := conn.WaitForNotification(waitCtx)
+		cancel()
+
+		switch {
+		case err == nil:
+		case ctx.Err() != nil:
+			return ctx.Err()
+		case errors.Is(err, context.DeadlineExceeded) && !conn.IsClosed():
+			pingCtx, cancel := context.WithTimeout(ctx, pingTimeout)
+			err = conn.Ping(pingCtx)
+			cancel()
+
+			if err != nil {
+				return err
+			}
+
+			continue
+		default:
+			return err
+		}
+
+		var event Event
+
+		err = json.Unmarshal([]byte(notification.Payload), &event)
+		if err != nil || event.Kind == Resync {
+			p.logger.Warn("ignoring malformed event", zap.String("payload", notification.Payload), zap.Error(err))
+			continue
+		}
+
+		p.Dispatch(event)
+	}
+}
+
+// reconnect retries the listener connection with exponential backoff until
+// it succeeds, returning nil once ctx is done.
+func (p *Postgres) reconnect(ctx context.Context) *pgx.Conn {
+	interval := minReconnectInterval
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(interval):
+		}
+
+		conn, err := p.listen(ctx)
+		if err == nil {
+			return conn
+		}
+
+		p.logger.Warn("event listener failed to reconnect", zap.String("channel", p.channel), zap.Error(err))
+
+		interval = min(interval*2, maxReconnectInterval)
+	}
+}
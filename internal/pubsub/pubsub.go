@@ -0,0 +1,75 @@
+// Package pubsub carries events about data changes between the processes
+// serving the API, so that each can drop the state it holds about them.
+package pubsub
+
+import (
+	"context"
+	"sync"
+)
+
+type Kind string
+
+const (
+	MovieChanged       Kind = "movie_changed"
+	UserChanged        Kind = "user_changed"
+	PermissionsChanged Kind = "permissions_changed"
+	TokensRevoked      Kind = "tokens_revoked"
+	UserDeleted        Kind = "user_deleted"
+
+	// Resync is dispatched locally, never published, when events may have
+	// been missed. Subscribers should drop everything they hold.
+	Resync Kind = "resync"
+)
+
+// Event describes a change to a record. ID is the movie ID for MovieChanged
+// and the user ID otherwise; Scope is the token scope for TokensRevoked.
+type Event struct {
+	Kind  Kind   `json:"kind"`
+	ID    int64  `json:"id,omitempty"`
+	Scope string `json:"scope,omitempty"`
+}
+
+type Handler func(Event)
+
+// Publisher sends an event to every process subscribed to the bus, this one
+// included. Publishing is best effort: failures are logged, not returned,
+// since the change the event describes has already been made.
+type Publisher interface {
+	Publish(ctx context.Context, event Event)
+}
+
+// Dispatcher fans events out to the handlers subscribed in this process.
+type Dispatcher struct {
+	mu       sync.RWMutex
+	handlers []Handler
+}
+
+func (d *Dispatcher) Subscribe(handler Handler) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.handlers = append(d.handlers, handler)
+}
+
+func (d *Dispatcher) Dispatch(event Event) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	for _, handler := range d.handlers {
+		handler(event)
+	}
+}
+
+// Local is a bus confined to one process, for backends that cannot be shared
+// between processes.
+type Local struct {
+	Dispatcher
+}
+
+func NewLocal() *Local {
+	return &Local{}
+}
+
+func (l *Local) Publish(_ context.Context, event Event) {
+	l.Dispatch(event)
+}
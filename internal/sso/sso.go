@@ -0,0 +1,172 @@
+// Package sso signs users in through an OpenID Connect provider, using the
+// authorization code flow with PKCE.
+package sso
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+// ErrInvalidLogin is returned by Exchange when the provider rejects the code
+// or the ID token it returns does not verify.
+var ErrInvalidLogin = errors.New("invalid OpenID Connect login")
+
+type Config struct {
+	IssuerURL    string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+}
+
+// Login holds what must be kept between sending the user to the provider and
+// their return: the state identifying the login, the nonce the ID token must
+// carry and the PKCE verifier.
+type Login struct {
+	State    string
+	Nonce    string
+	Verifier string
+}
+
+// Identity is what the provider asserts about the user who signed in.
+type Identity struct {
+	Issuer        string
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+}
+
+// Client talks to one provider. Its discovery document is fetched on first
+// use rather than at startup, so that the API starts while the provider is
+// unreachable, and fetched again after a failure.
+type Client struct {
+	cfg Config
+
+	mu       sync.Mutex
+	provider *oidc.Provider
+}
+
+func New(cfg Config) *Client {
+	return &Client{cfg: cfg}
+}
+
+func (c *Client) discover(ctx context.Context) (*oidc.Provider, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.provider != nil {
+		return c.provider, nil
+	}
+
+	provider, err := oidc.NewProvider(ctx, c.cfg.IssuerURL)
+	if err != nil {
+		return nil, fmt.Errorf("discover %s: %w", c.cfg.IssuerURL, err)
+	}
+
+	c.provider = provider
+
+	return provider, nil
+}
+
+func (c *Client) oauth2Config(provider *oidc.Provider) *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     c.cfg.ClientID,
+		ClientSecret: c.cfg.ClientSecret,
+		RedirectURL:  c.cfg.RedirectURL,
+		Endpoint:     provider.Endpoint(),
+		Scopes:       c.cfg.Scopes,
+	}
+}
+
+// Begin starts a login and returns it with the provider URL to send the user
+// to.
+func (c *Client) Begin(ctx context.Context) (*Login, string, error) {
+	provider, err := c.discover(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+
+	state, err := randomString()
+	if err != nil {
+		return nil, "", err
+	}
+
+	nonce, err := randomString()
+	if err != nil {
+		return nil, "", err
+	}
+
+	login := &Login{State: state, Nonce: nonce, Verifier: oauth2.GenerateVerifier()}
+
+	url := c.oauth2Config(provider).AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(login.Verifier))
+
+	return login, url, nil
+}
+
+// Exchange redeems the code the provider returned for login and returns the
+// identity its ID token asserts.
+func (c *Client) Exchange(ctx context.Context, login *Login, code string) (*Identity, error) {
+	provider, err := c.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := c.oauth2Config(provider).Exchange(ctx, code, oauth2.VerifierOption(login.Verifier))
+	if err != nil {
+		var retrieveErr *oauth2.RetrieveError
+		if errors.As(err, &retrieveErr) {
+			return nil, ErrInvalidLogin
+		}
+		return nil, err
+	}
+
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return nil, ErrInvalidLogin
+	}
+
+	idToken, err := provider.Verifier(&oidc.Config{ClientID: c.cfg.ClientID}).Verify(ctx, rawIDToken)
+	if err != nil || idToken.Nonce != login.Nonce {
+		return nil, ErrInvalidLogin
+	}
+
+	var claims struct {
+		Email         string `json:"email"`
+		EmailVerified bool   `json:"email_verified"`
+		Name          string `json:"name"`
+	}
+
+	err = idToken.Claims(&claims)
+	if err != nil {
+		return nil, ErrInvalidLogin
+	}
+
+	identity := &Identity{
+		Issuer:        idToken.Issuer,
+		Subject:       idToken.Subject,
+		Email:         claims.Email,
+		EmailVerified: claims.EmailVerified,
+		Name:          claims.Name,
+	}
+
+	return identity, nil
+}
+
+func randomString() (string, error) {
+	randomBytes := make([]byte, 16)
+
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(randomBytes), nil
+}
@@ -0,0 +1,146 @@
+package sso
+
+import (
+	"autherain/golang_arxiv/internal/sso/ssotest"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"testing"
+)
+
+func newTestClient(t *testing.T) (*Client, *ssotest.Provider) {
+	t.Helper()
+
+	provider, err := ssotest.NewProvider("client", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(provider.Close)
+
+	client := New(Config{
+		IssuerURL:    provider.URL,
+		ClientID:     "client",
+		ClientSecret: "secret",
+		RedirectURL:  "https://app.example.com/callback",
+		Scopes:       []string{"openid", "email", "profile"},
+	})
+
+	return client, provider
+}
+
+// begin starts a login and has the provider authorize it with claims.
+func begin(t *testing.T, client *Client, provider *ssotest.Provider, claims map[string]any) (*Login, string) {
+	t.Helper()
+
+	login, authorizationURL, err := client.Begin(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, err := provider.Authorize(authorizationURL, claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return login, code
+}
+
+func TestExchange(t *testing.T) {
+	client, provider := newTestClient(t)
+
+	login, code := begin(t, client, provider, map[string]any{
+		"sub":            "alice",
+		"email":          "alice@example.com",
+		"email_verified": true,
+		"name":           "Alice",
+	})
+
+	identity, err := client.Exchange(context.Background(), login, code)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := Identity{
+		Issuer:        provider.URL,
+		Subject:       "alice",
+		Email:         "alice@example.com",
+		EmailVerified: true,
+		Name:          "Alice",
+	}
+	if *identity != want {
+		t.Errorf("got identity %+v; want %+v", *identity, want)
+	}
+
+	verifiers := provider.Verifiers()
+	if len(verifiers) != 1 || verifiers[0] != login.Verifier {
+		t.Errorf("got verifiers %q sent on exchange; want [%q]", verifiers, login.Verifier)
+	}
+}
+
+func TestExchangeRejects(t *testing.T) {
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		claims map[string]any
+		setup  func(provider *ssotest.Provider, login *Login)
+	}{
+		{
+			name:   "nonce mismatch",
+			claims: map[string]any{"nonce": "another login's nonce"},
+		},
+		{
+			name: "bad signature",
+			setup: func(provider *ssotest.Provider, login *Login) {
+				provider.SignWith(otherKey)
+			},
+		},
+		{
+			name: "wrong verifier",
+			setup: func(provider *ssotest.Provider, login *Login) {
+				login.Verifier = "a verifier the challenge was not derived from"
+			},
+		},
+		{
+			name:   "wrong audience",
+			claims: map[string]any{"aud": "another client"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, provider := newTestClient(t)
+
+			login, code := begin(t, client, provider, tt.claims)
+
+			if tt.setup != nil {
+				tt.setup(provider, login)
+			}
+
+			_, err := client.Exchange(context.Background(), login, code)
+			if !errors.Is(err, ErrInvalidLogin) {
+				t.Errorf("got error %v; want ErrInvalidLogin", err)
+			}
+		})
+	}
+}
+
+func TestExchangeRejectsReusedCode(t *testing.T) {
+	client, provider := newTestClient(t)
+
+	login, code := begin(t, client, provider, nil)
+
+	_, err := client.Exchange(context.Background(), login, code)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = client.Exchange(context.Background(), login, code)
+	if !errors.Is(err, ErrInvalidLogin) {
+		t.Errorf("got error %v; want ErrInvalidLogin", err)
+	}
+}
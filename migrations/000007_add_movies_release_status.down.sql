@@ -0,0 +1,11 @@
+DROP INDEX IF EXISTS movies_status_idx;
+
+ALTER TABLE movies DROP CONSTRAINT IF EXISTS movies_year_check;
+
+ALTER TABLE movies DROP CONSTRAINT IF EXISTS movies_status_check;
+
+ALTER TABLE movies DROP COLUMN IF EXISTS release_dates;
+
+ALTER TABLE movies DROP COLUMN IF EXISTS status;
+
+ALTER TABLE movies ADD CONSTRAINT movies_year_check CHECK (year BETWEEN 1888 AND date_part('year', now()));
@@ -0,0 +1,17 @@
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS status text NOT NULL DEFAULT 'released';
+
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS release_dates jsonb NOT NULL DEFAULT '{}';
+
+ALTER TABLE movies ADD CONSTRAINT movies_status_check CHECK (status IN ('announced', 'in_production', 'released', 'cancelled'));
+
+ALTER TABLE movies DROP CONSTRAINT IF EXISTS movies_year_check;
+
+ALTER TABLE movies ADD CONSTRAINT movies_year_check CHECK (
+    year >= 1888
+    AND (
+        (status = 'released' AND year <= date_part('year', now()))
+        OR (status <> 'released' AND year <= date_part('year', now()) + 10)
+    )
+);
+
+CREATE INDEX IF NOT EXISTS movies_status_idx ON movies (status);
@@ -0,0 +1,16 @@
+CREATE TABLE IF NOT EXISTS movie_changes (
+    id bigserial PRIMARY KEY,
+    txid xid8 NOT NULL DEFAULT pg_current_xact_id(),
+    movie_id bigint NOT NULL,
+    operation text NOT NULL,
+    changed_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+
+ALTER TABLE movie_changes ADD CONSTRAINT movie_changes_operation_check CHECK (operation IN ('created', 'updated', 'deleted'));
+
+CREATE INDEX IF NOT EXISTS movie_changes_txid_id_idx ON movie_changes (txid, id);
+
+-- Seed the log with the existing catalogue so that a client starting from an
+-- empty token receives every movie.
+INSERT INTO movie_changes (movie_id, operation)
+SELECT id, 'created' FROM movies ORDER BY id;
@@ -0,0 +1,16 @@
+// Package migrations embeds the SQL migrations so that the API binary can
+// apply them without an external tool.
+package migrations
+
+import "embed"
+
+// Postgres holds the migrations for Postgres, named NNNNNN_name.up.sql and
+// NNNNNN_name.down.sql.
+//
+//go:embed *.sql
+var Postgres embed.FS
+
+// SQLite holds the same migrations written for SQLite, under sqlite/.
+//
+//go:embed sqlite/*.sql
+var SQLite embed.FS
@@ -0,0 +1,15 @@
+CREATE TABLE movies_new (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    created_at timestamp NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%S+00:00', 'now')),
+    title text NOT NULL,
+    year integer NOT NULL,
+    runtime integer NOT NULL,
+    genres text NOT NULL,
+    version integer NOT NULL DEFAULT 1
+);
+
+INSERT INTO movies_new SELECT * FROM movies;
+
+DROP TABLE movies;
+
+ALTER TABLE movies_new RENAME TO movies;
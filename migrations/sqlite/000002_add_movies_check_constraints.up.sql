@@ -0,0 +1,21 @@
+-- SQLite cannot add constraints to an existing table, so the table is rebuilt.
+-- CHECK constraints may not call strftime('now'), so the upper bound on year
+-- is only enforced by ValidateMovie.
+CREATE TABLE movies_new (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    created_at timestamp NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%S+00:00', 'now')),
+    title text NOT NULL,
+    year integer NOT NULL,
+    runtime integer NOT NULL,
+    genres text NOT NULL,
+    version integer NOT NULL DEFAULT 1,
+    CONSTRAINT movies_runtime_check CHECK (runtime >= 0),
+    CONSTRAINT movies_year_check CHECK (year >= 1888),
+    CONSTRAINT genres_length_check CHECK (json_array_length(genres) BETWEEN 1 AND 5)
+);
+
+INSERT INTO movies_new SELECT * FROM movies;
+
+DROP TABLE movies;
+
+ALTER TABLE movies_new RENAME TO movies;
@@ -0,0 +1,16 @@
+CREATE VIRTUAL TABLE IF NOT EXISTS movies_fts USING fts5(title, content='movies', content_rowid='id', tokenize='unicode61 remove_diacritics 0');
+
+INSERT INTO movies_fts (rowid, title) SELECT id, title FROM movies;
+
+CREATE TRIGGER IF NOT EXISTS movies_fts_insert AFTER INSERT ON movies BEGIN
+    INSERT INTO movies_fts (rowid, title) VALUES (new.id, new.title);
+END;
+
+CREATE TRIGGER IF NOT EXISTS movies_fts_delete AFTER DELETE ON movies BEGIN
+    INSERT INTO movies_fts (movies_fts, rowid, title) VALUES ('delete', old.id, old.title);
+END;
+
+CREATE TRIGGER IF NOT EXISTS movies_fts_update AFTER UPDATE OF title ON movies BEGIN
+    INSERT INTO movies_fts (movies_fts, rowid, title) VALUES ('delete', old.id, old.title);
+    INSERT INTO movies_fts (rowid, title) VALUES (new.id, new.title);
+END;
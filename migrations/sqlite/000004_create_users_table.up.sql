@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS users (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    created_at timestamp NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%S+00:00', 'now')),
+    name text NOT NULL,
+    email text COLLATE NOCASE UNIQUE NOT NULL,
+    password_hash blob NOT NULL,
+    activated boolean NOT NULL,
+    version integer NOT NULL DEFAULT 1
+);
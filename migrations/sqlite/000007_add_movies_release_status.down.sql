@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS movies_status_idx;
+
+ALTER TABLE movies DROP COLUMN release_dates;
+
+ALTER TABLE movies DROP COLUMN status;
@@ -0,0 +1,6 @@
+ALTER TABLE movies ADD COLUMN status text NOT NULL DEFAULT 'released'
+    CONSTRAINT movies_status_check CHECK (status IN ('announced', 'in_production', 'released', 'cancelled'));
+
+ALTER TABLE movies ADD COLUMN release_dates text NOT NULL DEFAULT '{}';
+
+CREATE INDEX IF NOT EXISTS movies_status_idx ON movies (status);
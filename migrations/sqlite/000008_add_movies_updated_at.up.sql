@@ -0,0 +1,7 @@
+-- ALTER TABLE ADD COLUMN cannot use an expression default, so existing rows
+-- are backfilled from created_at.
+ALTER TABLE movies ADD COLUMN updated_at timestamp NOT NULL DEFAULT '1970-01-01 00:00:00+00:00';
+
+UPDATE movies SET updated_at = created_at;
+
+CREATE INDEX IF NOT EXISTS movies_updated_at_idx ON movies (updated_at);
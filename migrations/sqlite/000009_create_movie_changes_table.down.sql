@@ -0,0 +1,4 @@
+DROP TRIGGER IF EXISTS movie_changes_delete;
+DROP TRIGGER IF EXISTS movie_changes_update;
+DROP TRIGGER IF EXISTS movie_changes_insert;
+DROP TABLE IF EXISTS movie_changes;
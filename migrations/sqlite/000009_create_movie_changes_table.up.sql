@@ -0,0 +1,22 @@
+-- SQLite has a single writer, so the log id is also the commit order.
+CREATE TABLE IF NOT EXISTS movie_changes (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    movie_id integer NOT NULL,
+    operation text NOT NULL CONSTRAINT movie_changes_operation_check CHECK (operation IN ('created', 'updated', 'deleted')),
+    changed_at timestamp NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%S+00:00', 'now'))
+);
+
+CREATE TRIGGER IF NOT EXISTS movie_changes_insert AFTER INSERT ON movies BEGIN
+    INSERT INTO movie_changes (movie_id, operation) VALUES (new.id, 'created');
+END;
+
+CREATE TRIGGER IF NOT EXISTS movie_changes_update AFTER UPDATE ON movies BEGIN
+    INSERT INTO movie_changes (movie_id, operation) VALUES (new.id, 'updated');
+END;
+
+CREATE TRIGGER IF NOT EXISTS movie_changes_delete AFTER DELETE ON movies BEGIN
+    INSERT INTO movie_changes (movie_id, operation) VALUES (old.id, 'deleted');
+END;
+
+INSERT INTO movie_changes (movie_id, operation)
+SELECT id, 'created' FROM movies ORDER BY id;
@@ -0,0 +1,6 @@
+ALTER TABLE movies ADD COLUMN created_by integer REFERENCES users ON DELETE SET NULL;
+
+CREATE INDEX IF NOT EXISTS movies_created_by_idx ON movies (created_by);
+
+INSERT INTO permissions (code)
+VALUES ('movies:admin');
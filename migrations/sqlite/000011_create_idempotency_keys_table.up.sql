@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+    user_id integer NOT NULL,
+    key text NOT NULL,
+    fingerprint blob NOT NULL,
+    status_code integer,
+    response_headers text,
+    response_body blob,
+    created_at timestamp NOT NULL,
+    expiry timestamp NOT NULL,
+    PRIMARY KEY (user_id, key)
+);
+
+CREATE INDEX IF NOT EXISTS idempotency_keys_expiry_idx ON idempotency_keys (expiry);
@@ -0,0 +1,3 @@
+ALTER TABLE users ADD COLUMN deletion_requested_at timestamp;
+
+CREATE INDEX IF NOT EXISTS users_deletion_requested_at_idx ON users (deletion_requested_at) WHERE deletion_requested_at IS NOT NULL;
@@ -0,0 +1,9 @@
+-- Entries outlive the users they refer to, so user_id is not a foreign key.
+CREATE TABLE IF NOT EXISTS audit_log (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    user_id integer NOT NULL,
+    action text NOT NULL,
+    created_at timestamp NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%S+00:00', 'now'))
+);
+
+CREATE INDEX IF NOT EXISTS audit_log_user_id_idx ON audit_log (user_id);
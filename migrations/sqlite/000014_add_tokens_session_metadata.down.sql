@@ -0,0 +1,13 @@
+CREATE TABLE tokens_old (
+    hash blob PRIMARY KEY,
+    user_id integer NOT NULL REFERENCES users ON DELETE CASCADE,
+    expiry timestamp NOT NULL,
+    scope text NOT NULL
+);
+
+INSERT INTO tokens_old (hash, user_id, expiry, scope)
+SELECT hash, user_id, expiry, scope FROM tokens;
+
+DROP TABLE tokens;
+
+ALTER TABLE tokens_old RENAME TO tokens;
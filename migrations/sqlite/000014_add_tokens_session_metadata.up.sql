@@ -0,0 +1,21 @@
+-- SQLite cannot add an autoincrementing column, so the table is rebuilt.
+CREATE TABLE tokens_new (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    hash blob NOT NULL UNIQUE,
+    user_id integer NOT NULL REFERENCES users ON DELETE CASCADE,
+    expiry timestamp NOT NULL,
+    scope text NOT NULL,
+    created_at timestamp NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%S+00:00', 'now')),
+    last_used_at timestamp,
+    ip text NOT NULL DEFAULT '',
+    user_agent text NOT NULL DEFAULT ''
+);
+
+INSERT INTO tokens_new (hash, user_id, expiry, scope)
+SELECT hash, user_id, expiry, scope FROM tokens;
+
+DROP TABLE tokens;
+
+ALTER TABLE tokens_new RENAME TO tokens;
+
+CREATE INDEX IF NOT EXISTS tokens_user_id_scope_idx ON tokens (user_id, scope);
@@ -0,0 +1,4 @@
+ALTER TABLE tokens ADD COLUMN family text;
+ALTER TABLE tokens ADD COLUMN rotated_at timestamp;
+
+CREATE INDEX IF NOT EXISTS tokens_family_idx ON tokens (family) WHERE family IS NOT NULL;
@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS oidc_logins (
+    state text PRIMARY KEY,
+    nonce text NOT NULL,
+    verifier text NOT NULL,
+    expiry timestamp NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS oidc_logins_expiry_idx ON oidc_logins (expiry);
@@ -0,0 +1,4 @@
+-- Logins started before their client was given a secret cannot be completed.
+DELETE FROM oidc_logins;
+
+ALTER TABLE oidc_logins ADD COLUMN secret_hash blob NOT NULL DEFAULT x'';